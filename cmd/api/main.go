@@ -46,36 +46,70 @@ func main() {
 	// Initialize metrics
 	metrics := metricsPkg.NewMetrics()
 
-	// Initialize email fetcher
+	// Initialize email fetcher of the mailbox in the config file
+	checkpoints := service.NewCheckpointStore(db)
+
 	var fetcher service.EmailFetcher
 	if cfg.Gmail.UseIMAP {
-		fetcher, err = service.NewIMAPFetcher(&cfg.Gmail)
+		fetcher, err = service.NewIMAPFetcher(0, &cfg.Gmail, checkpoints)
 		if err != nil {
 			logrus.Fatalf("Failed to create IMAP fetcher: %v", err)
 		}
 		logrus.Info("Using IMAP for email fetching")
 	} else {
-		fetcher, err = service.NewGmailAPIFetcher(&cfg.Gmail)
+		fetcher, err = service.NewGmailAPIFetcher(0, &cfg.Gmail, checkpoints)
 		if err != nil {
 			logrus.Fatalf("Failed to create Gmail API fetcher: %v", err)
 		}
 		logrus.Info("Using Gmail API for email fetching")
 	}
 
+	// Initialize mail accounts fetched next to it
+	accounts := service.NewAccountStore(db, checkpoints, &cfg.Gmail)
+
 	// Initialize email parser
-	parser := service.NewEmailParser(db)
+	parser, err := service.NewEmailParser(db, &cfg.Parser)
+	if err != nil {
+		logrus.Fatalf("Failed to create email parser: %v", err)
+	}
 
 	// Initialize email forwarder
-	forwarder, err := service.NewEmailForwarder(&cfg.Gmail)
-	if err != nil {
-		logrus.Fatalf("Failed to create email forwarder: %v", err)
+	var forwarder service.EmailForwarder
+	if cfg.SMTP.Enabled {
+		forwarder, err = service.NewSMTPForwarder(&cfg.SMTP)
+		if err != nil {
+			logrus.Fatalf("Failed to create SMTP forwarder: %v", err)
+		}
+		logrus.Info("Using SMTP for email forwarding")
+	} else {
+		forwarder, err = service.NewGmailAPIForwarder(&cfg.Gmail)
+		if err != nil {
+			logrus.Fatalf("Failed to create Gmail API forwarder: %v", err)
+		}
+		logrus.Info("Using Gmail API for email forwarding")
 	}
 
+	// Initialize outbound queue
+	outbox := service.NewOutbox(db, &cfg.Scheduler)
+
+	// Initialize run history
+	runs := service.NewRunHistory(db, cfg.Scheduler.RunHistory)
+
+	// Initialize leader election between replicas
+	var elector *service.LeaderElector
+	if cfg.Scheduler.LeaderElection {
+		elector = service.NewLeaderElector(db, &cfg.Scheduler)
+		logrus.Infof("Leader election enabled, instance ID %s", elector.ID())
+	}
+
+	// Initialize the settings shared by the replicas
+	settings := service.NewSettingStore(db)
+
 	// Initialize scheduler
-	scheduler := schedulerSvc.New(&cfg.Scheduler, fetcher, parser, forwarder, metrics)
+	scheduler := schedulerSvc.New(&cfg.Scheduler, fetcher, accounts, parser, forwarder, outbox, runs, elector, settings, metrics)
 
 	// Initialize HTTP handlers
-	handlers := handlerPkg.NewHandlers(db, parser, scheduler, metrics)
+	handlers := handlerPkg.NewHandlers(db, parser, outbox, scheduler, metrics, cfg.SMTP.Enabled)
 
 	// Setup HTTP server
 	r := router.SetupRouter(handlers)
@@ -123,9 +157,9 @@ func main() {
 		logrus.Errorf("HTTP server shutdown error: %v", err)
 	}
 
-	// Close fetcher
-	if err := fetcher.Close(); err != nil {
-		logrus.Errorf("Failed to close fetcher: %v", err)
+	// Close fetchers
+	if err := scheduler.Close(); err != nil {
+		logrus.Errorf("Failed to close fetchers: %v", err)
 	}
 
 	// Close forwarder
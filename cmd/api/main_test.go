@@ -1,14 +1,27 @@
 package main_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-message"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+	"gorm.io/gorm/schema"
 
 	cfgPkg "smart-mail-relay-go/config"
 	"smart-mail-relay-go/internal/model"
 	"smart-mail-relay-go/internal/service"
+	schedulerSvc "smart-mail-relay-go/internal/service/scheduler"
 )
 
 func TestConfigValidation(t *testing.T) {
@@ -46,6 +59,158 @@ func TestConfigValidation(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSchedulerSchedule(t *testing.T) {
+	cfg := &cfgPkg.SchedulerConfig{IntervalMinutes: 7}
+	assert.Equal(t, "@every 7m", cfg.Schedule())
+
+	cfg.Cron = "0 9-17 * * MON-FRI"
+	assert.Equal(t, "0 9-17 * * MON-FRI", cfg.Schedule())
+
+	s := schedulerSvc.New(cfg, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	assert.Equal(t, "0 9-17 * * MON-FRI", s.Schedule())
+
+	for _, spec := range []string{"@every 30s", "*/10 * * * * *", "0 */5 * * * *", "@hourly"} {
+		assert.NoError(t, s.Reschedule(spec), spec)
+		assert.Equal(t, spec, s.Schedule())
+	}
+
+	err := s.Reschedule("every five minutes")
+	assert.True(t, errors.Is(err, schedulerSvc.ErrInvalidSchedule))
+	assert.Equal(t, "@hourly", s.Schedule())
+}
+
+func TestPoller(t *testing.T) {
+	cfg := &cfgPkg.SchedulerConfig{
+		FetchBackoffBase: time.Minute,
+		FetchBackoffMax:  10 * time.Minute,
+		CircuitThreshold: 3,
+		CircuitCooldown:  15 * time.Minute,
+		IdleThreshold:    2,
+		IdleMaxInterval:  time.Hour,
+	}
+	fetchErr := errors.New("connection reset")
+
+	// Each step tries a fetch at an offset from the start and, if it is
+	// allowed, records its outcome; probe expects the fetch to probe a
+	// half-open circuit, and next is the expected next fetch, 0 for none
+	type step struct {
+		at      time.Duration
+		trigger string
+		allow   bool
+		probe   bool
+		count   int
+		err     error
+		circuit string
+		next    time.Duration
+	}
+
+	// The first three steps open the circuit after CircuitThreshold failures
+	opening := []step{
+		{0, schedulerSvc.TriggerSchedule, true, false, 0, fetchErr, schedulerSvc.CircuitClosed, time.Minute},
+		{30 * time.Second, schedulerSvc.TriggerSchedule, false, false, 0, nil, schedulerSvc.CircuitClosed, time.Minute},
+		{time.Minute, schedulerSvc.TriggerSchedule, true, false, 0, fetchErr, schedulerSvc.CircuitClosed, 3 * time.Minute},
+		{3 * time.Minute, schedulerSvc.TriggerSchedule, true, false, 0, fetchErr, schedulerSvc.CircuitOpen, 18 * time.Minute},
+		{10 * time.Minute, schedulerSvc.TriggerSchedule, false, false, 0, nil, schedulerSvc.CircuitOpen, 18 * time.Minute},
+		{10 * time.Minute, schedulerSvc.TriggerPush, false, false, 0, nil, schedulerSvc.CircuitOpen, 18 * time.Minute},
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"threshold opens the circuit", opening},
+		{"half-open probe failure opens it again", append(opening[:len(opening):len(opening)],
+			step{18 * time.Minute, schedulerSvc.TriggerSchedule, true, true, 0, fetchErr, schedulerSvc.CircuitOpen, 33 * time.Minute},
+			step{20 * time.Minute, schedulerSvc.TriggerSchedule, false, false, 0, nil, schedulerSvc.CircuitOpen, 33 * time.Minute},
+		)},
+		{"successful probe closes the circuit", append(opening[:len(opening):len(opening)],
+			step{18 * time.Minute, schedulerSvc.TriggerSchedule, true, true, 1, nil, schedulerSvc.CircuitClosed, 0},
+			step{19 * time.Minute, schedulerSvc.TriggerSchedule, true, false, 1, fetchErr, schedulerSvc.CircuitClosed, 20 * time.Minute},
+		)},
+		{"manual trigger bypasses backoff and circuit", append(opening[:len(opening):len(opening)],
+			step{11 * time.Minute, schedulerSvc.TriggerManual, true, true, 0, nil, schedulerSvc.CircuitClosed, 0},
+		)},
+		{"idle polling slows down and resets when mail arrives", []step{
+			{0, schedulerSvc.TriggerSchedule, true, false, 0, nil, schedulerSvc.CircuitClosed, 0},
+			{time.Minute, schedulerSvc.TriggerSchedule, true, false, 0, nil, schedulerSvc.CircuitClosed, 3 * time.Minute},
+			{2 * time.Minute, schedulerSvc.TriggerSchedule, false, false, 0, nil, schedulerSvc.CircuitClosed, 3 * time.Minute},
+			{2 * time.Minute, schedulerSvc.TriggerPush, true, false, 0, nil, schedulerSvc.CircuitClosed, 6 * time.Minute},
+			{6 * time.Minute, schedulerSvc.TriggerSchedule, true, false, 0, nil, schedulerSvc.CircuitClosed, 14 * time.Minute},
+			{7 * time.Minute, schedulerSvc.TriggerSchedule, false, false, 0, nil, schedulerSvc.CircuitClosed, 14 * time.Minute},
+			{7 * time.Minute, schedulerSvc.TriggerPush, true, false, 2, nil, schedulerSvc.CircuitClosed, 0},
+			{8 * time.Minute, schedulerSvc.TriggerSchedule, true, false, 0, nil, schedulerSvc.CircuitClosed, 0},
+		}},
+	}
+
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := schedulerSvc.NewPoller(cfg, "support")
+			for i, st := range tt.steps {
+				now := start.Add(st.at)
+				allowed, _ := p.Allow(st.trigger, now)
+				assert.Equal(t, st.allow, allowed, "step %d", i)
+				assert.Equal(t, st.probe, p.State().Circuit == schedulerSvc.CircuitHalfOpen, "step %d", i)
+				if allowed {
+					p.Record(st.trigger, now, st.count, st.err)
+				}
+
+				state := p.State()
+				assert.Equal(t, st.circuit, state.Circuit, "step %d", i)
+				if st.next == 0 {
+					assert.Nil(t, state.NextFetch, "step %d", i)
+				} else if assert.NotNil(t, state.NextFetch, "step %d", i) {
+					assert.Equal(t, start.Add(st.next), *state.NextFetch, "step %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSMTPConfigValidation(t *testing.T) {
+	config := &cfgPkg.Config{
+		Server: cfgPkg.ServerConfig{
+			Port: "8080",
+		},
+		Database: cfgPkg.DatabaseConfig{
+			Host:   "localhost",
+			User:   "test",
+			DBName: "test",
+		},
+		Gmail: cfgPkg.GmailConfig{
+			UseIMAP:      true,
+			IMAPUser:     "test",
+			IMAPPassword: "test",
+		},
+		SMTP: cfgPkg.SMTPConfig{
+			Enabled: true,
+			Host:    "smtp.example.com",
+			Port:    587,
+			From:    "relay@example.com",
+		},
+		Scheduler: cfgPkg.SchedulerConfig{
+			IntervalMinutes: 5,
+		},
+	}
+
+	assert.NoError(t, config.Validate())
+
+	// SMTP enabled without a sender address
+	config.SMTP.From = ""
+	assert.Error(t, config.Validate())
+}
+
+func TestNewSMTPForwarder(t *testing.T) {
+	_, err := service.NewSMTPForwarder(&cfgPkg.SMTPConfig{TLSMode: "starttls", Auth: "login"})
+	assert.NoError(t, err)
+
+	_, err = service.NewSMTPForwarder(&cfgPkg.SMTPConfig{TLSMode: "ssl", Auth: "plain"})
+	assert.Error(t, err)
+
+	_, err = service.NewSMTPForwarder(&cfgPkg.SMTPConfig{TLSMode: "tls", Auth: "cram-md5"})
+	assert.Error(t, err)
+}
+
 func TestDatabaseDSN(t *testing.T) {
 	config := cfgPkg.DatabaseConfig{
 		Host:     "localhost",
@@ -61,7 +226,8 @@ func TestDatabaseDSN(t *testing.T) {
 }
 
 func TestEmailParserExtractKeyword(t *testing.T) {
-	parser := service.NewEmailParser(nil)
+	parser, err := service.NewEmailParser(nil, nil)
+	assert.NoError(t, err)
 
 	// Test valid subject format
 	keyword, err := parser.ExtractKeyword("urgent - John Doe")
@@ -79,6 +245,515 @@ func TestEmailParserExtractKeyword(t *testing.T) {
 	assert.Equal(t, "", keyword)
 }
 
+func TestEmailParserParseSubject(t *testing.T) {
+	parser, err := service.NewEmailParser(nil, nil)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		subject   string
+		keyword   string
+		recipient string
+	}{
+		{"Re: Fwd: urgent - Bob", "urgent", "Bob"},
+		{"RE[2]: AW: WG: invoice – Jane Doe", "invoice", "Jane Doe"},
+		{"回复：转发: 销售－张三", "销售", "张三"},
+		{"[SALES] Quote for ACME", "SALES", ""},
+		{"[SALES] Quote - ACME", "SALES", ""},
+		{"[SALES] Tomorrow's quote", "SALES", ""},
+		{"[SALES] - Jane Doe", "SALES", "Jane Doe"},
+		{"Re: [SALES] To: Bob", "SALES", "Bob"},
+		{"Fw: hello world", "hello", ""},
+		{"Re:", "", ""},
+	}
+
+	for _, tt := range tests {
+		parts := parser.ParseSubject(tt.subject)
+		assert.Equal(t, tt.keyword, parts.Keyword, tt.subject)
+		assert.Equal(t, tt.recipient, parts.Recipient, tt.subject)
+	}
+
+	_, err = service.NewEmailParser(nil, &cfgPkg.ParserConfig{SubjectPatterns: []string{"("}})
+	assert.Error(t, err)
+
+	parser, err = service.NewEmailParser(nil, &cfgPkg.ParserConfig{
+		SubjectPatterns: []string{`^(?P<recipient>[^:]+):\s*(?P<keyword>\S+)`},
+	})
+	assert.NoError(t, err)
+	parts := parser.ParseSubject("Re: Alice: billing question")
+	assert.Equal(t, "billing", parts.Keyword)
+	assert.Equal(t, "Alice", parts.Recipient)
+}
+
+func TestMatchesKeyword(t *testing.T) {
+	tests := []struct {
+		matchType string
+		keyword   string
+		subject   string
+		expected  bool
+	}{
+		{model.MatchTypeExact, "urgent", "Urgent", true},
+		{model.MatchTypeExact, "urgent", "urgent-fix", false},
+		{model.MatchTypePrefix, "inv", "Invoice", true},
+		{model.MatchTypePrefix, "invoice", "inv", false},
+		{model.MatchTypeGlob, "order-*", "ORDER-123", true},
+		{model.MatchTypeGlob, "order-?", "order-12", false},
+		{model.MatchTypeRegex, `^ticket-\d+$`, "ticket-42", true},
+		{model.MatchTypeRegex, `^ticket-\d+$`, "Ticket-42", false},
+	}
+
+	for _, tt := range tests {
+		rule := &model.ForwardRule{Keyword: tt.keyword, MatchType: tt.matchType}
+		assert.Equal(t, tt.expected, service.MatchesKeyword(rule, tt.subject), "%s %q vs %q", tt.matchType, tt.keyword, tt.subject)
+	}
+}
+
+func TestValidateKeywordPattern(t *testing.T) {
+	assert.NoError(t, service.ValidateKeywordPattern(model.MatchTypeRegex, `^sales-(eu|us)$`))
+	assert.Error(t, service.ValidateKeywordPattern(model.MatchTypeRegex, `sales-(`))
+	assert.Error(t, service.ValidateKeywordPattern(model.MatchTypeGlob, `sales-[`))
+	assert.Error(t, service.ValidateKeywordPattern("fuzzy", "sales"))
+}
+
+func TestMatchesConditions(t *testing.T) {
+	email := service.EmailMessage{
+		From:    "Jane Doe <jane@customer.example>",
+		To:      []string{"support@company.com"},
+		CC:      []string{"Sales <sales@company.com>"},
+		Body:    "Please find the invoice attached.",
+		Headers: map[string]string{"List-Id": "<announce.lists.example>"},
+	}
+
+	rule := &model.ForwardRule{
+		Conditions: []model.RuleCondition{
+			{Field: model.ConditionFieldFromDomain, Operator: model.ConditionOpEquals, Value: "Customer.example"},
+			{Field: model.ConditionFieldCc, Operator: model.ConditionOpEquals, Value: "sales@company.com"},
+			{Field: model.ConditionFieldBody, Operator: model.ConditionOpContains, Value: "INVOICE"},
+		},
+	}
+	assert.True(t, service.MatchesConditions(rule, email))
+
+	rule.Conditions = append(rule.Conditions, model.RuleCondition{
+		Field: model.ConditionFieldHeader, Header: "list-id", Operator: model.ConditionOpRegex, Value: `other\.lists`,
+	})
+	assert.False(t, service.MatchesConditions(rule, email))
+
+	rule.ConditionLogic = model.ConditionLogicOr
+	assert.True(t, service.MatchesConditions(rule, email))
+
+	assert.Error(t, service.ValidateCondition(&model.RuleCondition{Field: model.ConditionFieldHeader, Value: "x"}))
+	assert.Error(t, service.ValidateCondition(&model.RuleCondition{Field: model.ConditionFieldBody, Operator: model.ConditionOpRegex, Value: "("}))
+	assert.NoError(t, service.ValidateCondition(&model.RuleCondition{Field: model.ConditionFieldFrom, Value: "jane@customer.example"}))
+}
+
+func TestSelectRules(t *testing.T) {
+	email := service.EmailMessage{From: "billing@customer.example"}
+
+	// rule is an enabled exact "invoice" rule delivering to its own address
+	rule := func(id uint, priority int, cont bool) model.ForwardRule {
+		return model.ForwardRule{
+			ID:          id,
+			Keyword:     "invoice",
+			Priority:    priority,
+			Continue:    cont,
+			TargetEmail: fmt.Sprintf("team%d@company.com", id),
+			Enabled:     true,
+		}
+	}
+	prefix := rule(1, 0, true)
+	prefix.MatchType, prefix.Keyword = model.MatchTypePrefix, "inv"
+	conditionsOnly := rule(2, 0, true)
+	conditionsOnly.Keyword = ""
+	conditionsOnly.Conditions = []model.RuleCondition{{Field: model.ConditionFieldFromDomain, Value: "customer.example"}}
+	disabled := rule(3, 0, false)
+	disabled.Enabled = false
+	other := rule(4, 0, false)
+	other.Keyword = "quote"
+
+	tests := []struct {
+		name  string
+		rules []model.ForwardRule
+		want  []uint
+	}{
+		{"lower priority first, stop after it", []model.ForwardRule{rule(1, 10, false), rule(2, 5, false)}, []uint{2}},
+		{"negative priority first", []model.ForwardRule{rule(1, 0, false), rule(2, -1, false)}, []uint{2}},
+		{"equal priority, lowest ID first", []model.ForwardRule{rule(3, 0, false), rule(2, 0, false)}, []uint{2}},
+		{"equal priority, exact before prefix", []model.ForwardRule{prefix, rule(5, 0, false)}, []uint{5}},
+		{"equal priority, keyword before conditions", []model.ForwardRule{conditionsOnly, rule(5, 0, true)}, []uint{5, 2}},
+		{"continue up to the first stop", []model.ForwardRule{rule(4, 3, false), rule(3, 2, false), rule(2, 1, true), rule(1, 0, true)}, []uint{1, 2, 3}},
+		{"continue on the last rule", []model.ForwardRule{rule(1, 0, true), rule(2, 1, true)}, []uint{1, 2}},
+		{"disabled rule skipped", []model.ForwardRule{disabled, rule(5, 1, false)}, []uint{5}},
+		{"disabled rule does not stop", []model.ForwardRule{rule(1, 0, true), disabled, rule(5, 1, false)}, []uint{1, 5}},
+		{"no matching rule", []model.ForwardRule{other, disabled}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint
+			for _, match := range service.SelectRules(tt.rules, email, "invoice", nil) {
+				got = append(got, match.Rule.ID)
+				assert.Equal(t, []string{match.Rule.TargetEmail}, match.Recipients.To)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRuleRecipients(t *testing.T) {
+	rule := &model.ForwardRule{
+		TargetEmail: "team@company.com",
+		Targets: []model.RuleTarget{
+			{Email: "lead@company.com", Role: model.RecipientRoleTo},
+			{Email: "manager@company.com", Role: model.RecipientRoleCc},
+			{Email: "archive@company.com", Role: model.RecipientRoleBcc},
+			{Email: "Team@company.com", Role: model.RecipientRoleBcc},
+		},
+	}
+
+	recipients := service.RuleRecipients(rule, nil)
+	assert.Equal(t, []string{"team@company.com", "lead@company.com"}, recipients.To)
+	assert.Equal(t, []string{"manager@company.com"}, recipients.Cc)
+	assert.Equal(t, []string{"archive@company.com"}, recipients.Bcc)
+	assert.Len(t, recipients.All(), 4)
+
+	recipients = service.RuleRecipients(&model.ForwardRule{ResolveRecipient: true}, &model.Contact{Name: "Alice", Email: "alice@company.com"})
+	assert.Equal(t, []string{"alice@company.com"}, recipients.To)
+}
+
+func TestValidateContact(t *testing.T) {
+	contact := &model.Contact{Name: " Alice ", Email: "Alice Smith <alice@company.com>"}
+	assert.NoError(t, service.ValidateContact(contact))
+	assert.Equal(t, "Alice", contact.Name)
+	assert.Equal(t, "alice@company.com", contact.Email)
+
+	assert.Error(t, service.ValidateContact(&model.Contact{Name: "", Email: "bob@company.com"}))
+	assert.Error(t, service.ValidateContact(&model.Contact{Name: "Bob", Email: "not-an-address"}))
+}
+
+func TestValidateAccount(t *testing.T) {
+	account := &model.MailAccount{Name: " support ", Email: "support@company.com", ClientID: "id", ClientSecret: "secret", RefreshToken: "token"}
+	assert.NoError(t, service.ValidateAccount(account))
+	assert.Equal(t, "support", account.Name)
+	assert.Equal(t, model.FetchMethodGmailAPI, account.FetchMethod)
+
+	account = &model.MailAccount{Name: "sales", Email: "sales@company.com", FetchMethod: model.FetchMethodIMAP, IMAPHost: "imap.company.com", IMAPUser: "sales", IMAPPassword: "secret"}
+	assert.NoError(t, service.ValidateAccount(account))
+	assert.Equal(t, 993, account.IMAPPort)
+
+	assert.Error(t, service.ValidateAccount(&model.MailAccount{Name: "sales", Email: "sales@company.com", FetchMethod: model.FetchMethodIMAP}))
+	assert.Error(t, service.ValidateAccount(&model.MailAccount{Name: "sales", Email: "sales@company.com", FetchMethod: "pop3"}))
+	assert.Error(t, service.ValidateAccount(&model.MailAccount{Name: " ", Email: "sales@company.com"}))
+}
+
+func TestSecretSerializer(t *testing.T) {
+	accountSchema, err := schema.Parse(&model.MailAccount{}, &sync.Map{}, schema.NamingStrategy{})
+	assert.NoError(t, err)
+	field := accountSchema.LookUpField("IMAPPassword")
+	ctx := context.Background()
+
+	assert.Error(t, model.SetSecretKey([]byte("short")))
+	assert.NoError(t, model.SetSecretKey(bytes.Repeat([]byte{7}, 32)))
+
+	stored, err := field.Serializer.Value(ctx, field, reflect.Value{}, "app-password")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.(string), model.SecretPrefix))
+	assert.NotContains(t, stored, "app-password")
+
+	again, err := field.Serializer.Value(ctx, field, reflect.Value{}, "app-password")
+	assert.NoError(t, err)
+	assert.NotEqual(t, stored, again)
+
+	var account model.MailAccount
+	assert.NoError(t, field.Serializer.Scan(ctx, field, reflect.ValueOf(&account), []byte(stored.(string))))
+	assert.Equal(t, "app-password", account.IMAPPassword)
+
+	// Plaintext written before encryption was enabled is read as it is
+	assert.NoError(t, field.Serializer.Scan(ctx, field, reflect.ValueOf(&account), "legacy"))
+	assert.Equal(t, "legacy", account.IMAPPassword)
+
+	stored, err = field.Serializer.Value(ctx, field, reflect.Value{}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", stored)
+
+	assert.Error(t, field.Serializer.Scan(ctx, field, reflect.ValueOf(&account), model.SecretPrefix+"bm90LWVuY3J5cHRlZA=="))
+}
+
+func TestRuleAppliesToAccount(t *testing.T) {
+	rule := &model.ForwardRule{}
+	assert.True(t, service.AppliesToAccount(rule, 0))
+	assert.True(t, service.AppliesToAccount(rule, 2))
+
+	rule.Accounts = []model.RuleAccount{{AccountID: 0}, {AccountID: 3}}
+	assert.True(t, service.AppliesToAccount(rule, 0))
+	assert.True(t, service.AppliesToAccount(rule, 3))
+	assert.False(t, service.AppliesToAccount(rule, 2))
+}
+
+func TestForwardTemplates(t *testing.T) {
+	parser, err := service.NewEmailParser(nil, nil)
+	assert.NoError(t, err)
+
+	rule := &model.ForwardRule{
+		ID:              7,
+		Keyword:         "invoice",
+		SubjectTemplate: "[{{upper .Keyword}}] for {{.Recipient}}: {{.Subject}}",
+		HeaderTemplate:  "Routed by rule {{.Rule.ID}} from {{.From}}",
+		FooterTemplate:  "-- relayed for {{.Recipient}}",
+	}
+	assert.NoError(t, service.ValidateTemplates(service.RuleTemplates(rule)))
+
+	sample := service.SampleEmail(rule)
+	sample.HTMLBody = "<p>Hello</p>"
+	preview, err := parser.PreviewForward(rule, sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "[INVOICE] for Alice: invoice - Alice", preview.Subject)
+	assert.Contains(t, preview.TextBody, "Routed by rule 7 from Jane Sender <jane@example.com>\r\n\r\nHello")
+	assert.Contains(t, preview.TextBody, "-- relayed for Alice")
+	assert.Contains(t, preview.HTMLBody, "Jane Sender &lt;jane@example.com&gt;")
+
+	assert.Error(t, service.ValidateTemplates(service.ForwardTemplates{Subject: "{{.Subject"}))
+	assert.Error(t, service.ValidateTemplates(service.ForwardTemplates{Header: "{{.Unknown}}"}))
+}
+
+func TestBuildForwardMessage(t *testing.T) {
+	raw := "From: Alice <alice@example.com>\r\n" +
+		"To: relay@example.com\r\n" +
+		"Subject: [invoice] March\r\n" +
+		"Message-Id: <march@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"Invoice attached.\r\n"
+	original := service.EmailMessage{
+		ID:       "<march@example.com>",
+		Subject:  "[invoice] March",
+		From:     "Alice <alice@example.com>",
+		To:       []string{"relay@example.com"},
+		Body:     "Invoice attached.\r\n",
+		HTMLBody: "<p>Invoice attached.</p>",
+		Raw:      []byte(raw),
+		Attachments: []service.Attachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4")},
+		},
+	}
+	recipients := service.Recipients{
+		To:  []string{"bob@example.com"},
+		Cc:  []string{"carol@example.com"},
+		Bcc: []string{"dave@example.com"},
+	}
+
+	// part is a leaf MIME part: its content type, file name and a text its
+	// decoded body contains
+	type part struct {
+		contentType string
+		filename    string
+		body        string
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		headers map[string]string
+		parts   []part
+	}{
+		{
+			name: "inline",
+			mode: model.DeliveryModeInline,
+			headers: map[string]string{
+				"From":            "relay@example.com",
+				"To":              "bob@example.com",
+				"Cc":              "carol@example.com",
+				"Subject":         "Fwd: [invoice] March",
+				"X-Original-From": "Alice <alice@example.com>",
+			},
+			parts: []part{
+				{"text/plain", "", "---------- Forwarded message ----------\r\nFrom: Alice <alice@example.com>"},
+				{"text/html", "", "<p>Invoice attached.</p>"},
+				{"application/pdf", "invoice.pdf", "%PDF-1.4"},
+			},
+		},
+		{
+			name: "attachment",
+			mode: model.DeliveryModeAttachment,
+			headers: map[string]string{
+				"From":            "relay@example.com",
+				"To":              "bob@example.com",
+				"Cc":              "carol@example.com",
+				"Subject":         "Fwd: [invoice] March",
+				"X-Original-From": "Alice <alice@example.com>",
+			},
+			parts: []part{
+				{"text/plain", "", "The original message is attached."},
+				{"message/rfc822", "original.eml", raw},
+			},
+		},
+		{
+			name: "redirect",
+			mode: model.DeliveryModeRedirect,
+			headers: map[string]string{
+				"Resent-From": "relay@example.com",
+				"Resent-To":   "bob@example.com",
+				"Resent-Cc":   "carol@example.com",
+				"From":        "Alice <alice@example.com>",
+				"To":          "relay@example.com",
+				"Subject":     "[invoice] March",
+				"Message-Id":  "<march@example.com>",
+			},
+			parts: []part{
+				{"text/plain", "", "Invoice attached."},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded, err := service.BuildForwardMessage("relay@example.com", original, recipients, service.ForwardOptions{Mode: tt.mode})
+			assert.NoError(t, err)
+			assert.NotContains(t, forwarded, "dave@example.com")
+
+			entity, err := message.Read(strings.NewReader(forwarded))
+			assert.NoError(t, err)
+			for key, value := range tt.headers {
+				assert.Equal(t, value, entity.Header.Get(key), key)
+			}
+			if tt.mode == model.DeliveryModeRedirect {
+				assert.NotEmpty(t, entity.Header.Get("Resent-Date"))
+			}
+
+			var parts []part
+			err = entity.Walk(func(path []int, entity *message.Entity, err error) error {
+				if err != nil {
+					return err
+				}
+				contentType, _, _ := entity.Header.ContentType()
+				if strings.HasPrefix(contentType, "multipart/") {
+					return nil
+				}
+				_, params, _ := entity.Header.ContentDisposition()
+				body, err := io.ReadAll(entity.Body)
+				if err != nil {
+					return err
+				}
+				parts = append(parts, part{contentType, params["filename"], string(body)})
+				return nil
+			})
+			assert.NoError(t, err)
+
+			if assert.Len(t, parts, len(tt.parts)) {
+				for i, want := range tt.parts {
+					assert.Equal(t, want.contentType, parts[i].contentType)
+					assert.Equal(t, want.filename, parts[i].filename)
+					assert.Contains(t, parts[i].body, want.body)
+				}
+			}
+		})
+	}
+
+	// Attaching or redirecting needs the raw message
+	withoutRaw := original
+	withoutRaw.Raw = nil
+	for _, mode := range []string{model.DeliveryModeAttachment, model.DeliveryModeRedirect} {
+		_, err := service.BuildForwardMessage("relay@example.com", withoutRaw, recipients, service.ForwardOptions{Mode: mode})
+		assert.Error(t, err, mode)
+	}
+
+	_, err := service.BuildForwardMessage("relay@example.com", original, recipients, service.ForwardOptions{Mode: "bounce"})
+	assert.Error(t, err)
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	outbox := service.NewOutbox(nil, &cfgPkg.SchedulerConfig{
+		MaxRetries:     3,
+		RetryBaseDelay: time.Minute,
+		RetryMaxDelay:  5 * time.Minute,
+	})
+
+	assert.Equal(t, time.Minute, outbox.RetryDelay(1))
+	assert.Equal(t, 2*time.Minute, outbox.RetryDelay(2))
+	assert.Equal(t, 4*time.Minute, outbox.RetryDelay(3))
+	assert.Equal(t, 5*time.Minute, outbox.RetryDelay(4))
+	assert.Equal(t, 5*time.Minute, outbox.RetryDelay(100))
+
+	// Unset delays fall back to the defaults
+	assert.Equal(t, time.Minute, service.NewOutbox(nil, nil).RetryDelay(1))
+}
+
+func TestIsPermanent(t *testing.T) {
+	permanent := &service.PermanentError{Err: errors.New("invalid to header")}
+
+	assert.True(t, service.IsPermanent(permanent))
+	assert.True(t, service.IsPermanent(fmt.Errorf("failed to forward email: %w", permanent)))
+	assert.False(t, service.IsPermanent(errors.New("connection reset")))
+	assert.False(t, service.IsPermanent(nil))
+	assert.Equal(t, "invalid to header", permanent.Error())
+}
+
+func TestClassifyGmailError(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	apiError := func(code int, retryAfter string, reasons ...string) error {
+		err := &googleapi.Error{Code: code, Header: http.Header{}}
+		if retryAfter != "" {
+			err.Header.Set("Retry-After", retryAfter)
+		}
+		for _, reason := range reasons {
+			err.Errors = append(err.Errors, googleapi.ErrorItem{Reason: reason})
+		}
+		return err
+	}
+
+	tests := []struct {
+		name       string
+		err        error
+		retry      bool
+		permanent  bool
+		retryAfter time.Duration
+	}{
+		{"network error", errors.New("connection reset"), true, false, 0},
+		{"cancelled", context.Canceled, false, false, 0},
+		{"rate limit", apiError(http.StatusTooManyRequests, ""), true, false, 0},
+		{"rate limit with retry after", apiError(http.StatusTooManyRequests, "120"), true, false, 2 * time.Minute},
+		{"rate limit with retry after date", apiError(http.StatusTooManyRequests, now.Add(90*time.Second).Format(http.TimeFormat)), true, false, 90 * time.Second},
+		{"server error", apiError(http.StatusServiceUnavailable, "30"), true, false, 30 * time.Second},
+		{"request timeout", apiError(http.StatusRequestTimeout, ""), true, false, 0},
+		{"rate limit 403", apiError(http.StatusForbidden, "", "userRateLimitExceeded"), true, false, 0},
+		{"daily quota 403", apiError(http.StatusForbidden, "", "dailyLimitExceeded"), false, false, 0},
+		{"unauthorized", apiError(http.StatusUnauthorized, ""), false, false, 0},
+		{"invalid recipient", apiError(http.StatusBadRequest, ""), false, true, 0},
+		{"not found", apiError(http.StatusNotFound, ""), false, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classified, retry := service.ClassifyGmailError(tt.err, now)
+			assert.Equal(t, tt.retry, retry)
+			assert.Equal(t, tt.permanent, service.IsPermanent(classified))
+			assert.Equal(t, tt.retryAfter, service.RetryAfter(classified))
+			assert.ErrorIs(t, classified, tt.err)
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"30", 30 * time.Second},
+		{"3600", time.Hour},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(2 * time.Minute).Format(http.TimeFormat), 2 * time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, service.ParseRetryAfter(tt.value, now), tt.value)
+	}
+}
+
 func TestForwardRuleValidation(t *testing.T) {
 	rule := model.ForwardRule{
 		Keyword:     "test",
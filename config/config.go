@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
 	"time"
 
@@ -12,6 +13,8 @@ type Config struct {
 	Server    ServerConfig    `mapstructure:"server"`
 	Database  DatabaseConfig  `mapstructure:"database"`
 	Gmail     GmailConfig     `mapstructure:"gmail"`
+	SMTP      SMTPConfig      `mapstructure:"smtp"`
+	Parser    ParserConfig    `mapstructure:"parser"`
 	Scheduler SchedulerConfig `mapstructure:"scheduler"`
 }
 
@@ -30,6 +33,9 @@ type DatabaseConfig struct {
 	Password string `mapstructure:"password"`
 	DBName   string `mapstructure:"dbname"`
 	SSLMode  string `mapstructure:"sslmode"`
+	// SecretKey is the base64 of the 32-byte AES key the credentials of
+	// mail accounts are encrypted with
+	SecretKey string `mapstructure:"secret_key"`
 }
 
 // GmailConfig holds Gmail API configuration
@@ -43,12 +49,98 @@ type GmailConfig struct {
 	IMAPPort     int    `mapstructure:"imap_port"`
 	IMAPUser     string `mapstructure:"imap_user"`
 	IMAPPassword string `mapstructure:"imap_password"`
+	IMAPIdle     bool   `mapstructure:"imap_idle"`
+	// MaxMessagesPerCycle caps how many messages the Gmail API fetcher lists
+	// in one processing cycle; the remaining backlog is fetched next cycle
+	MaxMessagesPerCycle int `mapstructure:"max_messages_per_cycle"`
+}
+
+// SMTPConfig holds SMTP transport configuration used for forwarding instead
+// of the Gmail API
+type SMTPConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	From     string `mapstructure:"from"`
+	// TLSMode is one of "starttls", "tls" (implicit TLS) or "none"
+	TLSMode string `mapstructure:"tls_mode"`
+	// Auth is one of "plain", "login", "xoauth2" or "none"
+	Auth string `mapstructure:"auth"`
+	// OAuth2 credentials used with the xoauth2 mechanism
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	RefreshToken string `mapstructure:"refresh_token"`
+	TokenURL     string `mapstructure:"token_url"`
+}
+
+// ParserConfig holds subject parsing configuration. Empty lists use the
+// built-in defaults.
+type ParserConfig struct {
+	// SubjectPatterns are regular expressions tried in order against the
+	// subject; the first match wins. The keyword is taken from the named
+	// group "keyword" (or the first group) and the recipient name from the
+	// named group "recipient".
+	SubjectPatterns []string `mapstructure:"subject_patterns"`
+	// StripPrefixes are reply/forward prefixes such as "Re" or "Fwd" removed
+	// from the subject before matching, with or without a trailing colon
+	StripPrefixes []string `mapstructure:"strip_prefixes"`
 }
 
 // SchedulerConfig holds scheduler configuration
 type SchedulerConfig struct {
-	IntervalMinutes int `mapstructure:"interval_minutes"`
-	MaxRetries      int `mapstructure:"max_retries"`
+	// Cron is the schedule of the processing cycles: a cron spec with an
+	// optional seconds field, or a descriptor such as "@hourly" or
+	// "@every 30s". If empty, a cycle runs every IntervalMinutes.
+	Cron            string `mapstructure:"cron"`
+	IntervalMinutes int    `mapstructure:"interval_minutes"`
+	// FetchBackoffBase is how long scheduled cycles wait before fetching
+	// again after a failed fetch; it doubles with every consecutive failure
+	// up to FetchBackoffMax
+	FetchBackoffBase time.Duration `mapstructure:"fetch_backoff_base"`
+	FetchBackoffMax  time.Duration `mapstructure:"fetch_backoff_max"`
+	// CircuitThreshold is the number of consecutive fetch failures that open
+	// the circuit, which stops fetching for CircuitCooldown before a single
+	// fetch probes the mailbox again; 0 never opens it
+	CircuitThreshold int           `mapstructure:"circuit_threshold"`
+	CircuitCooldown  time.Duration `mapstructure:"circuit_cooldown"`
+	// IdleThreshold is the number of consecutive fetches without new mail
+	// after which scheduled cycles fetch less often, doubling the time
+	// between fetches up to IdleMaxInterval; 0 disables adaptive polling
+	IdleThreshold   int           `mapstructure:"idle_threshold"`
+	IdleMaxInterval time.Duration `mapstructure:"idle_max_interval"`
+	// MaxRetries is how many times a failed forward is retried before it is
+	// moved to the dead letter state
+	MaxRetries int `mapstructure:"max_retries"`
+	// RetryBaseDelay is the delay before the first retry; it doubles with
+	// every further attempt up to RetryMaxDelay
+	RetryBaseDelay time.Duration `mapstructure:"retry_base_delay"`
+	RetryMaxDelay  time.Duration `mapstructure:"retry_max_delay"`
+	// ClaimTimeout is how long a forward may stay claimed by a sender before
+	// it is considered abandoned, e.g. after a crash, and claimed again
+	ClaimTimeout time.Duration `mapstructure:"claim_timeout"`
+	// Workers is the number of emails parsed and outbox jobs delivered
+	// concurrently
+	Workers int `mapstructure:"workers"`
+	// MaxInFlightSends caps the forwards being sent at the same time across
+	// all processing cycles; 0 uses Workers
+	MaxInFlightSends int `mapstructure:"max_in_flight_sends"`
+	// RunHistory is the number of processing cycles kept in the run history
+	RunHistory int `mapstructure:"run_history"`
+	// LeaderElection lets only one of several replicas sharing the database
+	// run processing cycles, elected through a lease in the database
+	LeaderElection bool `mapstructure:"leader_election"`
+	// InstanceID identifies this replica in the lease; empty uses the host
+	// name and process ID
+	InstanceID string `mapstructure:"instance_id"`
+	// LeaseTTL is how long the leader's lease stays valid without renewal,
+	// i.e. how quickly another replica takes over after the leader dies
+	LeaseTTL time.Duration `mapstructure:"lease_ttl"`
+	// SyncInterval is how often the mail accounts and the schedule are
+	// reloaded from the database, applying changes made through other
+	// replicas
+	SyncInterval time.Duration `mapstructure:"sync_interval"`
 }
 
 // LoadConfig loads configuration from environment variables and config file
@@ -95,9 +187,30 @@ func setDefaults() {
 	viper.SetDefault("gmail.use_imap", false)
 	viper.SetDefault("gmail.imap_host", "imap.gmail.com")
 	viper.SetDefault("gmail.imap_port", 993)
+	viper.SetDefault("gmail.imap_idle", false)
+	viper.SetDefault("gmail.max_messages_per_cycle", 500)
+
+	viper.SetDefault("smtp.enabled", false)
+	viper.SetDefault("smtp.port", 587)
+	viper.SetDefault("smtp.tls_mode", "starttls")
+	viper.SetDefault("smtp.auth", "plain")
 
 	viper.SetDefault("scheduler.interval_minutes", 5)
+	viper.SetDefault("scheduler.fetch_backoff_base", "30s")
+	viper.SetDefault("scheduler.fetch_backoff_max", "10m")
+	viper.SetDefault("scheduler.circuit_threshold", 5)
+	viper.SetDefault("scheduler.circuit_cooldown", "15m")
+	viper.SetDefault("scheduler.idle_threshold", 3)
+	viper.SetDefault("scheduler.idle_max_interval", "30m")
 	viper.SetDefault("scheduler.max_retries", 3)
+	viper.SetDefault("scheduler.retry_base_delay", "1m")
+	viper.SetDefault("scheduler.retry_max_delay", "1h")
+	viper.SetDefault("scheduler.claim_timeout", "10m")
+	viper.SetDefault("scheduler.workers", 4)
+	viper.SetDefault("scheduler.run_history", 100)
+	viper.SetDefault("scheduler.leader_election", true)
+	viper.SetDefault("scheduler.lease_ttl", "30s")
+	viper.SetDefault("scheduler.sync_interval", "1m")
 }
 
 // bindEnvVars binds environment variables to configuration keys
@@ -114,6 +227,7 @@ func bindEnvVars() {
 	viper.BindEnv("database.password", "DB_PASSWORD")
 	viper.BindEnv("database.dbname", "DB_NAME")
 	viper.BindEnv("database.sslmode", "DB_SSLMODE")
+	viper.BindEnv("database.secret_key", "DB_SECRET_KEY")
 
 	// Gmail
 	viper.BindEnv("gmail.client_id", "GMAIL_CLIENT_ID")
@@ -125,10 +239,43 @@ func bindEnvVars() {
 	viper.BindEnv("gmail.imap_port", "GMAIL_IMAP_PORT")
 	viper.BindEnv("gmail.imap_user", "GMAIL_IMAP_USER")
 	viper.BindEnv("gmail.imap_password", "GMAIL_IMAP_PASSWORD")
+	viper.BindEnv("gmail.imap_idle", "GMAIL_IMAP_IDLE")
+	viper.BindEnv("gmail.max_messages_per_cycle", "GMAIL_MAX_MESSAGES_PER_CYCLE")
+
+	// SMTP
+	viper.BindEnv("smtp.enabled", "SMTP_ENABLED")
+	viper.BindEnv("smtp.host", "SMTP_HOST")
+	viper.BindEnv("smtp.port", "SMTP_PORT")
+	viper.BindEnv("smtp.username", "SMTP_USERNAME")
+	viper.BindEnv("smtp.password", "SMTP_PASSWORD")
+	viper.BindEnv("smtp.from", "SMTP_FROM")
+	viper.BindEnv("smtp.tls_mode", "SMTP_TLS_MODE")
+	viper.BindEnv("smtp.auth", "SMTP_AUTH")
+	viper.BindEnv("smtp.client_id", "SMTP_CLIENT_ID")
+	viper.BindEnv("smtp.client_secret", "SMTP_CLIENT_SECRET")
+	viper.BindEnv("smtp.refresh_token", "SMTP_REFRESH_TOKEN")
+	viper.BindEnv("smtp.token_url", "SMTP_TOKEN_URL")
 
 	// Scheduler
+	viper.BindEnv("scheduler.cron", "SCHEDULER_CRON")
 	viper.BindEnv("scheduler.interval_minutes", "SCHEDULER_INTERVAL_MINUTES")
+	viper.BindEnv("scheduler.fetch_backoff_base", "SCHEDULER_FETCH_BACKOFF_BASE")
+	viper.BindEnv("scheduler.fetch_backoff_max", "SCHEDULER_FETCH_BACKOFF_MAX")
+	viper.BindEnv("scheduler.circuit_threshold", "SCHEDULER_CIRCUIT_THRESHOLD")
+	viper.BindEnv("scheduler.circuit_cooldown", "SCHEDULER_CIRCUIT_COOLDOWN")
+	viper.BindEnv("scheduler.idle_threshold", "SCHEDULER_IDLE_THRESHOLD")
+	viper.BindEnv("scheduler.idle_max_interval", "SCHEDULER_IDLE_MAX_INTERVAL")
 	viper.BindEnv("scheduler.max_retries", "SCHEDULER_MAX_RETRIES")
+	viper.BindEnv("scheduler.retry_base_delay", "SCHEDULER_RETRY_BASE_DELAY")
+	viper.BindEnv("scheduler.retry_max_delay", "SCHEDULER_RETRY_MAX_DELAY")
+	viper.BindEnv("scheduler.claim_timeout", "SCHEDULER_CLAIM_TIMEOUT")
+	viper.BindEnv("scheduler.workers", "SCHEDULER_WORKERS")
+	viper.BindEnv("scheduler.max_in_flight_sends", "SCHEDULER_MAX_IN_FLIGHT_SENDS")
+	viper.BindEnv("scheduler.run_history", "SCHEDULER_RUN_HISTORY")
+	viper.BindEnv("scheduler.leader_election", "SCHEDULER_LEADER_ELECTION")
+	viper.BindEnv("scheduler.instance_id", "SCHEDULER_INSTANCE_ID")
+	viper.BindEnv("scheduler.lease_ttl", "SCHEDULER_LEASE_TTL")
+	viper.BindEnv("scheduler.sync_interval", "SCHEDULER_SYNC_INTERVAL")
 }
 
 // GetDSN returns the database connection string
@@ -137,6 +284,31 @@ func (c *DatabaseConfig) GetDSN() string {
 		c.User, c.Password, c.Host, c.Port, c.DBName)
 }
 
+// GetSecretKey returns the key mail account credentials are encrypted with,
+// or nil if none is configured
+func (c *DatabaseConfig) GetSecretKey() ([]byte, error) {
+	if c.SecretKey == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(c.SecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("database secret key must be base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("database secret key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// Schedule returns the cron spec of the processing cycles
+func (c *SchedulerConfig) Schedule() string {
+	if c.Cron != "" {
+		return c.Cron
+	}
+	return fmt.Sprintf("@every %dm", c.IntervalMinutes)
+}
+
 // Validate validates the configuration
 func (c *Config) Validate() error {
 	if c.Server.Port == "" {
@@ -147,6 +319,10 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("database host, user, and dbname are required")
 	}
 
+	if _, err := c.Database.GetSecretKey(); err != nil {
+		return err
+	}
+
 	if !c.Gmail.UseIMAP {
 		if c.Gmail.ClientID == "" || c.Gmail.ClientSecret == "" || c.Gmail.RefreshToken == "" {
 			return fmt.Errorf("Gmail OAuth2 credentials are required when not using IMAP")
@@ -157,8 +333,26 @@ func (c *Config) Validate() error {
 		}
 	}
 
-	if c.Scheduler.IntervalMinutes <= 0 {
-		return fmt.Errorf("scheduler interval must be greater than 0")
+	if c.SMTP.Enabled {
+		if c.SMTP.Host == "" || c.SMTP.Port <= 0 || c.SMTP.From == "" {
+			return fmt.Errorf("SMTP host, port, and from address are required when SMTP is enabled")
+		}
+	}
+
+	if c.Scheduler.Cron == "" && c.Scheduler.IntervalMinutes <= 0 {
+		return fmt.Errorf("scheduler cron or an interval greater than 0 is required")
+	}
+
+	if c.Scheduler.MaxRetries < 0 {
+		return fmt.Errorf("scheduler max retries must not be negative")
+	}
+
+	if c.Scheduler.CircuitThreshold < 0 || c.Scheduler.IdleThreshold < 0 {
+		return fmt.Errorf("scheduler circuit and idle thresholds must not be negative")
+	}
+
+	if c.Scheduler.Workers < 0 || c.Scheduler.MaxInFlightSends < 0 {
+		return fmt.Errorf("scheduler workers and max in-flight sends must not be negative")
 	}
 
 	return nil
@@ -25,7 +25,8 @@ func InitDatabase(cfg config.DatabaseConfig) (*gorm.DB, error) {
 		},
 	)
 
-	db, err := gorm.Open(mysql.Open(cfg.GetDSN()), &gorm.Config{Logger: gormLogger})
+	// TranslateError reports duplicate keys as gorm.ErrDuplicatedKey
+	db, err := gorm.Open(mysql.Open(cfg.GetDSN()), &gorm.Config{Logger: gormLogger, TranslateError: true})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
@@ -39,6 +40,18 @@ func InitDatabase(cfg config.DatabaseConfig) (*gorm.DB, error) {
 	sqlDB.SetMaxOpenConns(100)
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
+	key, err := cfg.GetSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if err := model.SetSecretKey(key); err != nil {
+			return nil, err
+		}
+	} else {
+		logrus.Warn("database.secret_key is not set, mail accounts with credentials cannot be saved")
+	}
+
 	if err := runMigrations(db); err != nil {
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
@@ -47,13 +60,116 @@ func InitDatabase(cfg config.DatabaseConfig) (*gorm.DB, error) {
 	return db, nil
 }
 
+// Unique indexes created by earlier versions
+const (
+	// keywordIndex is the name GORM gives the forward_rules keyword index
+	keywordIndex = "idx_forward_rules_keyword"
+	// processedMessageIndex and outboxJobIndex made message IDs unique across
+	// all mailboxes; they are unique per mail account now
+	processedMessageIndex = "idx_processed_emails_message_id"
+	outboxJobIndex        = "idx_outbox_job"
+	// checkpointIndex made checkpoints unique per address, shared by every
+	// mail account fetching it; existing checkpoints belong to account 0
+	checkpointIndex = "idx_mailbox_checkpoint"
+)
+
 func runMigrations(db *gorm.DB) error {
 	logrus.Info("Running database migrations...")
 
-	if err := db.AutoMigrate(&model.ForwardRule{}, &model.ProcessedEmail{}, &model.ForwardLog{}); err != nil {
+	// Rules with conditions may share a keyword, so AutoMigrate recreates the
+	// keyword index as a plain index
+	if err := dropUniqueIndex(db, &model.ForwardRule{}, keywordIndex); err != nil {
+		return err
+	}
+	if err := dropUniqueIndex(db, &model.ProcessedEmail{}, processedMessageIndex); err != nil {
+		return err
+	}
+	if err := dropUniqueIndex(db, &model.OutboxJob{}, outboxJobIndex); err != nil {
+		return err
+	}
+	if err := dropUniqueIndex(db, &model.MailboxCheckpoint{}, checkpointIndex); err != nil {
+		return err
+	}
+
+	if err := db.AutoMigrate(
+		&model.MailAccount{},
+		&model.ForwardRule{},
+		&model.RuleCondition{},
+		&model.RuleTarget{},
+		&model.RuleAccount{},
+		&model.Contact{},
+		&model.ProcessedEmail{},
+		&model.ForwardLog{},
+		&model.ForwardLogRecipient{},
+		&model.OutboxJob{},
+		&model.SchedulerRun{},
+		&model.SchedulerLease{},
+		&model.SchedulerSetting{},
+		&model.MailboxCheckpoint{},
+	); err != nil {
 		return fmt.Errorf("failed to auto migrate: %w", err)
 	}
 
+	if err := encryptAccountSecrets(db); err != nil {
+		return err
+	}
+
 	logrus.Info("Database migrations completed")
 	return nil
 }
+
+// encryptAccountSecrets encrypts the mail account credentials stored in
+// plaintext by earlier versions, once a secret key is configured
+func encryptAccountSecrets(db *gorm.DB) error {
+	if !model.SecretKeyConfigured() {
+		return nil
+	}
+
+	plaintext := func(column string) string {
+		return fmt.Sprintf("(%s <> '' AND %s NOT LIKE '%s%%')", column, column, model.SecretPrefix)
+	}
+
+	var accounts []model.MailAccount
+	if err := db.Where(plaintext("client_secret") + " OR " + plaintext("refresh_token") + " OR " + plaintext("imap_password")).
+		Find(&accounts).Error; err != nil {
+		return fmt.Errorf("failed to read mail account credentials: %w", err)
+	}
+
+	for i := range accounts {
+		account := &accounts[i]
+		if err := db.Model(account).Select("client_secret", "refresh_token", "imap_password").
+			UpdateColumns(account).Error; err != nil {
+			return fmt.Errorf("failed to encrypt credentials of mail account %s: %w", account.Name, err)
+		}
+		logrus.Infof("Encrypted credentials of mail account %s", account.Name)
+	}
+
+	return nil
+}
+
+// dropUniqueIndex removes a unique index created by earlier versions from the
+// table of value, if it exists
+func dropUniqueIndex(db *gorm.DB, value interface{}, name string) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(value) {
+		return nil
+	}
+
+	indexes, err := migrator.GetIndexes(value)
+	if err != nil {
+		return fmt.Errorf("failed to read indexes for %s: %w", name, err)
+	}
+
+	for _, index := range indexes {
+		if unique, ok := index.Unique(); index.Name() != name || !ok || !unique {
+			continue
+		}
+
+		logrus.Infof("Dropping unique index %s", name)
+		if err := migrator.DropIndex(value, name); err != nil {
+			return fmt.Errorf("failed to drop index %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
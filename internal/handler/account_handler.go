@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/internal/model"
+	service "smart-mail-relay-go/internal/service"
+	schedulerSvc "smart-mail-relay-go/internal/service/scheduler"
+)
+
+// GetAccounts returns all mail accounts
+func (h *Handlers) GetAccounts(c *gin.Context) {
+	var accounts []model.MailAccount
+	if err := h.db.Order("id").Find(&accounts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch mail accounts",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	responses := make([]AccountResponse, 0, len(accounts))
+	for _, account := range accounts {
+		responses = append(responses, newAccountResponse(&account))
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+// CreateAccount creates a new mail account and starts its pipeline
+func (h *Handlers) CreateAccount(c *gin.Context) {
+	var req AccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	account := model.MailAccount{Enabled: true}
+	applyAccountRequest(&account, &req)
+
+	if !validateAccount(c, &account) {
+		return
+	}
+
+	if err := h.db.Create(&account).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			accountExists(c, &account)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to create mail account",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	h.syncAccounts()
+	c.JSON(http.StatusCreated, newAccountResponse(&account))
+}
+
+// GetAccount returns a specific mail account
+func (h *Handlers) GetAccount(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid account ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var account model.MailAccount
+	if err := h.db.First(&account, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{
+				Error:   "not_found",
+				Message: "Mail account not found",
+				Code:    http.StatusNotFound,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch mail account",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, newAccountResponse(&account))
+}
+
+// UpdateAccount updates a mail account and restarts its pipeline
+func (h *Handlers) UpdateAccount(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid account ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var req AccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var account model.MailAccount
+	if err := h.db.First(&account, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{
+				Error:   "not_found",
+				Message: "Mail account not found",
+				Code:    http.StatusNotFound,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch mail account",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	applyAccountRequest(&account, &req)
+
+	if !validateAccount(c, &account) {
+		return
+	}
+
+	if err := h.db.Save(&account).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			accountExists(c, &account)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to update mail account",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	h.syncAccounts()
+	c.JSON(http.StatusOK, newAccountResponse(&account))
+}
+
+// DeleteAccount deletes a mail account and stops its pipeline. An account
+// that rules are scoped to cannot be deleted.
+func (h *Handlers) DeleteAccount(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid account ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var rules int64
+	if err := h.db.Model(&model.RuleAccount{}).Where("account_id = ?", id).Count(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to delete mail account",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+	if rules > 0 {
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   "account_in_use",
+			Message: "Mail account is used by forwarding rules; remove it from their account_ids first",
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+
+	result := h.db.Delete(&model.MailAccount{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to delete mail account",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Error:   "not_found",
+			Message: "Mail account not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	h.syncAccounts()
+	c.Status(http.StatusNoContent)
+}
+
+// applyAccountRequest copies the fields of an account request onto a mail
+// account. Empty secrets keep the stored ones.
+func applyAccountRequest(account *model.MailAccount, req *AccountRequest) {
+	account.Name = req.Name
+	account.Email = req.Email
+	account.FetchMethod = req.FetchMethod
+	account.ClientID = req.ClientID
+	account.IMAPHost = req.IMAPHost
+	account.IMAPPort = req.IMAPPort
+	account.IMAPUser = req.IMAPUser
+	account.IMAPIdle = req.IMAPIdle
+	account.Cron = req.Cron
+
+	if req.ClientSecret != "" {
+		account.ClientSecret = req.ClientSecret
+	}
+	if req.RefreshToken != "" {
+		account.RefreshToken = req.RefreshToken
+	}
+	if req.IMAPPassword != "" {
+		account.IMAPPassword = req.IMAPPassword
+	}
+	if req.Enabled != nil {
+		account.Enabled = *req.Enabled
+	}
+}
+
+// validateAccount checks the credentials and schedule of a mail account,
+// writing the error response if they are invalid or cannot be stored
+func validateAccount(c *gin.Context, account *model.MailAccount) bool {
+	if !model.SecretKeyConfigured() {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "configuration_error",
+			Message: model.ErrSecretKeyMissing.Error(),
+			Code:    http.StatusInternalServerError,
+		})
+		return false
+	}
+
+	err := service.ValidateAccount(account)
+	if err == nil && account.Cron != "" {
+		err = schedulerSvc.ValidateSchedule(account.Cron)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return false
+	}
+	return true
+}
+
+// accountExists writes the response for a mail account whose name is taken
+// by another account
+func accountExists(c *gin.Context, account *model.MailAccount) {
+	c.JSON(http.StatusConflict, ErrorResponse{
+		Error:   "duplicate_account",
+		Message: fmt.Sprintf("A mail account named %q already exists", account.Name),
+		Code:    http.StatusConflict,
+	})
+}
+
+// syncAccounts applies changed mail accounts to the scheduler of this
+// replica right away. Other replicas, and this one if that fails, apply the
+// change with their periodic sync.
+func (h *Handlers) syncAccounts() {
+	if err := h.scheduler.SyncAccounts(); err != nil {
+		logrus.Errorf("Failed to sync mail accounts: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/internal/model"
+	service "smart-mail-relay-go/internal/service"
+)
+
+// GetContacts returns all contacts
+func (h *Handlers) GetContacts(c *gin.Context) {
+	var contacts []model.Contact
+	if err := h.db.Order("name").Find(&contacts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch contacts",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	responses := make([]ContactResponse, 0, len(contacts))
+	for _, contact := range contacts {
+		responses = append(responses, newContactResponse(&contact))
+	}
+
+	c.JSON(http.StatusOK, responses)
+}
+
+// CreateContact creates a new contact
+func (h *Handlers) CreateContact(c *gin.Context) {
+	var req ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	contact := model.Contact{
+		Name:  req.Name,
+		Email: req.Email,
+	}
+
+	if err := service.ValidateContact(&contact); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if err := h.db.Create(&contact).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			contactExists(c, &contact)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to create contact",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, newContactResponse(&contact))
+}
+
+// GetContact returns a specific contact
+func (h *Handlers) GetContact(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid contact ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var contact model.Contact
+	if err := h.db.First(&contact, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{
+				Error:   "not_found",
+				Message: "Contact not found",
+				Code:    http.StatusNotFound,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch contact",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, newContactResponse(&contact))
+}
+
+// UpdateContact updates a contact
+func (h *Handlers) UpdateContact(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid contact ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var req ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Invalid request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var contact model.Contact
+	if err := h.db.First(&contact, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{
+				Error:   "not_found",
+				Message: "Contact not found",
+				Code:    http.StatusNotFound,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch contact",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	contact.Name = req.Name
+	contact.Email = req.Email
+
+	if err := service.ValidateContact(&contact); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if err := h.db.Save(&contact).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			contactExists(c, &contact)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to update contact",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, newContactResponse(&contact))
+}
+
+// DeleteContact deletes a contact
+func (h *Handlers) DeleteContact(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid contact ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if err := h.db.Delete(&model.Contact{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to delete contact",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// contactExists writes the response for a contact whose name is taken by
+// another contact
+func contactExists(c *gin.Context, contact *model.Contact) {
+	c.JSON(http.StatusConflict, ErrorResponse{
+		Error:   "duplicate_contact",
+		Message: fmt.Sprintf("A contact named %q already exists", contact.Name),
+		Code:    http.StatusConflict,
+	})
+}
+
+// ImportContacts creates or updates contacts from a CSV file with name and
+// email columns, sent either as the "file" field of a multipart form or as
+// the request body
+func (h *Handlers) ImportContacts(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+	if c.ContentType() == "multipart/form-data" {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "Missing file field",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "Failed to open uploaded file",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	result, err := service.ImportContactsCSV(h.db, body)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidCSV) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: err.Error(),
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to import contacts",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -19,17 +20,23 @@ import (
 type Handlers struct {
 	db        *gorm.DB
 	parser    *service.EmailParser
+	outbox    *service.Outbox
 	scheduler *schedulerSvc.Scheduler
 	metrics   *metricsPkg.Metrics
+	// smtpEnabled is true when forwarding through SMTP, which rules in the
+	// redirect delivery mode require
+	smtpEnabled bool
 }
 
 // NewHandlers creates new HTTP handlers
-func NewHandlers(db *gorm.DB, parser *service.EmailParser, scheduler *schedulerSvc.Scheduler, metrics *metricsPkg.Metrics) *Handlers {
+func NewHandlers(db *gorm.DB, parser *service.EmailParser, outbox *service.Outbox, scheduler *schedulerSvc.Scheduler, metrics *metricsPkg.Metrics, smtpEnabled bool) *Handlers {
 	return &Handlers{
-		db:        db,
-		parser:    parser,
-		scheduler: scheduler,
-		metrics:   metrics,
+		db:          db,
+		parser:      parser,
+		outbox:      outbox,
+		scheduler:   scheduler,
+		metrics:     metrics,
+		smtpEnabled: smtpEnabled,
 	}
 }
 
@@ -47,14 +54,36 @@ func (h *Handlers) SetupRoutes(router *gin.Engine) {
 		api.DELETE("/rules/:id", h.DeleteRule)
 		api.PATCH("/rules/:id/enable", h.EnableRule)
 		api.PATCH("/rules/:id/disable", h.DisableRule)
+		api.POST("/rules/:id/preview", h.PreviewRule)
+
+		api.GET("/accounts", h.GetAccounts)
+		api.POST("/accounts", h.CreateAccount)
+		api.GET("/accounts/:id", h.GetAccount)
+		api.PUT("/accounts/:id", h.UpdateAccount)
+		api.DELETE("/accounts/:id", h.DeleteAccount)
+
+		api.GET("/contacts", h.GetContacts)
+		api.POST("/contacts", h.CreateContact)
+		api.POST("/contacts/import", h.ImportContacts)
+		api.GET("/contacts/:id", h.GetContact)
+		api.PUT("/contacts/:id", h.UpdateContact)
+		api.DELETE("/contacts/:id", h.DeleteContact)
 
 		api.GET("/logs", h.GetLogs)
 		api.GET("/logs/:id", h.GetLog)
 
+		api.GET("/outbox", h.GetOutboxJobs)
+		api.GET("/outbox/:id", h.GetOutboxJob)
+		api.POST("/outbox/:id/retry", h.RetryOutboxJob)
+		api.DELETE("/outbox/:id", h.DropOutboxJob)
+
 		api.POST("/scheduler/start", schedulerHandler.Start(h.scheduler))
 		api.POST("/scheduler/stop", schedulerHandler.Stop(h.scheduler))
 		api.POST("/scheduler/run-once", schedulerHandler.RunOnce(h.scheduler))
 		api.GET("/scheduler/status", schedulerHandler.Status(h.scheduler))
+		api.PUT("/scheduler/schedule", schedulerHandler.Reschedule(h.scheduler))
+		api.GET("/scheduler/runs", schedulerHandler.GetRuns(h.scheduler))
+		api.GET("/scheduler/runs/:id", schedulerHandler.GetRun(h.scheduler))
 	}
 }
 
@@ -82,6 +111,35 @@ func (h *Handlers) HealthCheck(c *gin.Context) {
 		response.Metrics["scheduler"] = "stopped"
 	}
 
+	response.Metrics["leader"] = strconv.FormatBool(h.scheduler.IsLeader())
+
+	// Fetching is degraded while a mail account backs off after failures or
+	// its circuit is open, and fails once every account's circuit is open;
+	// the API itself keeps serving
+	accounts := h.scheduler.Accounts()
+	open, failing := 0, 0
+	for _, account := range accounts {
+		switch {
+		case account.Polling.Circuit == schedulerSvc.CircuitOpen:
+			open++
+		case account.Polling.ConsecutiveFailures > 0:
+			failing++
+		}
+		response.Metrics["fetch_circuit_"+account.Name] = account.Polling.Circuit
+		response.Metrics["fetch_failures_"+account.Name] = strconv.Itoa(account.Polling.ConsecutiveFailures)
+	}
+	switch {
+	case open > 0 && open == len(accounts):
+		response.Gmail = "error"
+	case open > 0 || failing > 0:
+		response.Gmail = "degraded"
+	}
+	if response.Gmail != "ok" && response.Status == "ok" {
+		response.Status = "degraded"
+	}
+
+	response.Metrics["active_cycles"] = strconv.Itoa(len(h.scheduler.ActiveCycles()))
+
 	response.Metrics["pull_count"] = "0"
 	response.Metrics["match_count"] = "0"
 	response.Metrics["forward_successes"] = "0"
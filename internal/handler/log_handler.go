@@ -36,7 +36,7 @@ func (h *Handlers) GetLogs(c *gin.Context) {
 		return
 	}
 
-	if err := h.db.Preload("Rule").Order("created_at DESC").Offset(offset).Limit(limit).Find(&logs).Error; err != nil {
+	if err := h.db.Preload("Rule.Conditions").Preload("Rule.Targets").Preload("Rule.Accounts").Preload("Recipients").Order("created_at DESC").Offset(offset).Limit(limit).Find(&logs).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Error:   "database_error",
 			Message: "Failed to fetch logs",
@@ -47,27 +47,7 @@ func (h *Handlers) GetLogs(c *gin.Context) {
 
 	var responses []ForwardLogResponse
 	for _, log := range logs {
-		response := ForwardLogResponse{
-			ID:        log.ID,
-			MessageID: log.MessageID,
-			RuleID:    log.RuleID,
-			Status:    log.Status,
-			ErrorMsg:  log.ErrorMsg,
-			CreatedAt: log.CreatedAt,
-		}
-
-		if log.Rule != nil {
-			response.Rule = &ForwardRuleResponse{
-				ID:          log.Rule.ID,
-				Keyword:     log.Rule.Keyword,
-				TargetEmail: log.Rule.TargetEmail,
-				Enabled:     log.Rule.Enabled,
-				CreatedAt:   log.Rule.CreatedAt,
-				UpdatedAt:   log.Rule.UpdatedAt,
-			}
-		}
-
-		responses = append(responses, response)
+		responses = append(responses, newForwardLogResponse(&log))
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -93,7 +73,7 @@ func (h *Handlers) GetLog(c *gin.Context) {
 	}
 
 	var log model.ForwardLog
-	if err := h.db.Preload("Rule").First(&log, id).Error; err != nil {
+	if err := h.db.Preload("Rule.Conditions").Preload("Rule.Targets").Preload("Rule.Accounts").Preload("Recipients").First(&log, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, ErrorResponse{
 				Error:   "not_found",
@@ -110,25 +90,7 @@ func (h *Handlers) GetLog(c *gin.Context) {
 		return
 	}
 
-	response := ForwardLogResponse{
-		ID:        log.ID,
-		MessageID: log.MessageID,
-		RuleID:    log.RuleID,
-		Status:    log.Status,
-		ErrorMsg:  log.ErrorMsg,
-		CreatedAt: log.CreatedAt,
-	}
-
-	if log.Rule != nil {
-		response.Rule = &ForwardRuleResponse{
-			ID:          log.Rule.ID,
-			Keyword:     log.Rule.Keyword,
-			TargetEmail: log.Rule.TargetEmail,
-			Enabled:     log.Rule.Enabled,
-			CreatedAt:   log.Rule.CreatedAt,
-			UpdatedAt:   log.Rule.UpdatedAt,
-		}
-	}
+	response := newForwardLogResponse(&log)
 
 	c.JSON(http.StatusOK, response)
 }
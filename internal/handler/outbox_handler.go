@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/internal/model"
+	service "smart-mail-relay-go/internal/service"
+)
+
+// GetOutboxJobs returns outbox jobs with pagination, optionally filtered by
+// status
+func (h *Handlers) GetOutboxJobs(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	offset := (page - 1) * limit
+
+	query := h.db.Model(&model.OutboxJob{})
+	switch status := c.Query("status"); status {
+	case "":
+	case model.OutboxStatusPending, model.OutboxStatusProcessing, model.OutboxStatusSent, model.OutboxStatusDead:
+		query = query.Where("status = ?", status)
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: "Status must be one of pending, processing, sent or dead",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to count outbox jobs",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	var jobs []model.OutboxJob
+	if err := query.Omit("Payload").Order("id DESC").Offset(offset).Limit(limit).Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch outbox jobs",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	responses := make([]OutboxJobResponse, 0, len(jobs))
+	for _, job := range jobs {
+		responses = append(responses, newOutboxJobResponse(&job))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs": responses,
+		"pagination": gin.H{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		},
+	})
+}
+
+// GetOutboxJob returns a specific outbox job
+func (h *Handlers) GetOutboxJob(c *gin.Context) {
+	id, ok := outboxJobID(c)
+	if !ok {
+		return
+	}
+
+	var job model.OutboxJob
+	if err := h.db.Omit("Payload").First(&job, id).Error; err != nil {
+		outboxJobError(c, err, "Failed to fetch outbox job")
+		return
+	}
+
+	c.JSON(http.StatusOK, newOutboxJobResponse(&job))
+}
+
+// RetryOutboxJob queues a dead outbox job again; it is sent in the next
+// processing cycle
+func (h *Handlers) RetryOutboxJob(c *gin.Context) {
+	id, ok := outboxJobID(c)
+	if !ok {
+		return
+	}
+
+	job, err := h.outbox.Retry(id)
+	if err != nil {
+		outboxJobError(c, err, "Failed to retry outbox job")
+		return
+	}
+
+	c.JSON(http.StatusOK, newOutboxJobResponse(job))
+}
+
+// DropOutboxJob deletes a dead outbox job
+func (h *Handlers) DropOutboxJob(c *gin.Context) {
+	id, ok := outboxJobID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.outbox.Drop(id); err != nil {
+		outboxJobError(c, err, "Failed to drop outbox job")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Outbox job dropped successfully",
+	})
+}
+
+// outboxJobID parses the job ID from the request path and writes an error
+// response if it is invalid
+func outboxJobID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid outbox job ID",
+			Code:    http.StatusBadRequest,
+		})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// outboxJobError writes the error response for a failed outbox job operation
+func outboxJobError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Error:   "not_found",
+			Message: "Outbox job not found",
+			Code:    http.StatusNotFound,
+		})
+	case errors.Is(err, service.ErrJobNotDead):
+		c.JSON(http.StatusConflict, ErrorResponse{
+			Error:   "invalid_state",
+			Message: "Only dead outbox jobs can be retried or dropped",
+			Code:    http.StatusConflict,
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: message,
+			Code:    http.StatusInternalServerError,
+		})
+	}
+}
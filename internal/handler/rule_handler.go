@@ -1,13 +1,17 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/mail"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
 	"smart-mail-relay-go/internal/model"
+	service "smart-mail-relay-go/internal/service"
 )
 
 // GetRules returns all forwarding rules
@@ -24,14 +28,7 @@ func (h *Handlers) GetRules(c *gin.Context) {
 
 	var responses []ForwardRuleResponse
 	for _, rule := range rules {
-		responses = append(responses, ForwardRuleResponse{
-			ID:          rule.ID,
-			Keyword:     rule.Keyword,
-			TargetEmail: rule.TargetEmail,
-			Enabled:     rule.Enabled,
-			CreatedAt:   rule.CreatedAt,
-			UpdatedAt:   rule.UpdatedAt,
-		})
+		responses = append(responses, newForwardRuleResponse(&rule))
 	}
 
 	c.JSON(http.StatusOK, responses)
@@ -49,15 +46,61 @@ func (h *Handlers) CreateRule(c *gin.Context) {
 		return
 	}
 
+	matchType := model.MatchTypeExact
+	if req.MatchType != "" {
+		matchType = req.MatchType
+	}
+
+	conditionLogic := model.ConditionLogicAnd
+	if req.ConditionLogic != "" {
+		conditionLogic = req.ConditionLogic
+	}
+
 	enabled := true
 	if req.Enabled != nil {
 		enabled = *req.Enabled
 	}
 
+	deliveryMode := model.DeliveryModeInline
+	if req.DeliveryMode != "" {
+		deliveryMode = req.DeliveryMode
+	}
+
+	var priority int
+	if req.Priority != nil {
+		priority = *req.Priority
+	}
+
 	rule := model.ForwardRule{
-		Keyword:     req.Keyword,
-		TargetEmail: req.TargetEmail,
-		Enabled:     enabled,
+		Keyword:          stringValue(req.Keyword),
+		MatchType:        matchType,
+		ConditionLogic:   conditionLogic,
+		Conditions:       newRuleConditions(req.Conditions),
+		Priority:         priority,
+		Continue:         req.Continue != nil && *req.Continue,
+		TargetEmail:      stringValue(req.TargetEmail),
+		Targets:          newRuleTargets(req.Targets),
+		Accounts:         newRuleAccounts(req.AccountIDs),
+		ResolveRecipient: req.ResolveRecipient != nil && *req.ResolveRecipient,
+		SubjectTemplate:  stringValue(req.SubjectTemplate),
+		HeaderTemplate:   stringValue(req.HeaderTemplate),
+		FooterTemplate:   stringValue(req.FooterTemplate),
+		OrderedDelivery:  req.OrderedDelivery != nil && *req.OrderedDelivery,
+		DeliveryMode:     deliveryMode,
+		Enabled:          enabled,
+	}
+
+	if err := h.validateRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if !h.checkRuleAccounts(c, req.AccountIDs) {
+		return
 	}
 
 	if err := h.db.Create(&rule).Error; err != nil {
@@ -69,14 +112,7 @@ func (h *Handlers) CreateRule(c *gin.Context) {
 		return
 	}
 
-	response := ForwardRuleResponse{
-		ID:          rule.ID,
-		Keyword:     rule.Keyword,
-		TargetEmail: rule.TargetEmail,
-		Enabled:     rule.Enabled,
-		CreatedAt:   rule.CreatedAt,
-		UpdatedAt:   rule.UpdatedAt,
-	}
+	response := newForwardRuleResponse(&rule)
 
 	c.JSON(http.StatusCreated, response)
 }
@@ -94,7 +130,7 @@ func (h *Handlers) GetRule(c *gin.Context) {
 	}
 
 	var rule model.ForwardRule
-	if err := h.db.First(&rule, id).Error; err != nil {
+	if err := h.db.Preload("Conditions").Preload("Targets").Preload("Accounts").First(&rule, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, ErrorResponse{
 				Error:   "not_found",
@@ -111,14 +147,7 @@ func (h *Handlers) GetRule(c *gin.Context) {
 		return
 	}
 
-	response := ForwardRuleResponse{
-		ID:          rule.ID,
-		Keyword:     rule.Keyword,
-		TargetEmail: rule.TargetEmail,
-		Enabled:     rule.Enabled,
-		CreatedAt:   rule.CreatedAt,
-		UpdatedAt:   rule.UpdatedAt,
-	}
+	response := newForwardRuleResponse(&rule)
 
 	c.JSON(http.StatusOK, response)
 }
@@ -146,7 +175,7 @@ func (h *Handlers) UpdateRule(c *gin.Context) {
 	}
 
 	var rule model.ForwardRule
-	if err := h.db.First(&rule, id).Error; err != nil {
+	if err := h.db.Preload("Conditions").Preload("Targets").Preload("Accounts").First(&rule, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, ErrorResponse{
 				Error:   "not_found",
@@ -163,13 +192,121 @@ func (h *Handlers) UpdateRule(c *gin.Context) {
 		return
 	}
 
-	rule.Keyword = req.Keyword
-	rule.TargetEmail = req.TargetEmail
+	if req.Keyword != nil {
+		rule.Keyword = *req.Keyword
+	}
+	if req.MatchType != "" {
+		rule.MatchType = req.MatchType
+	}
+	if req.ConditionLogic != "" {
+		rule.ConditionLogic = req.ConditionLogic
+	}
+	// Conditions are replaced only when the request includes them
+	replaceConditions := req.Conditions != nil
+	if replaceConditions {
+		rule.Conditions = newRuleConditions(req.Conditions)
+	}
+
+	if req.TargetEmail != nil {
+		rule.TargetEmail = *req.TargetEmail
+	}
+	// Targets are replaced only when the request includes them
+	replaceTargets := req.Targets != nil
+	if replaceTargets {
+		rule.Targets = newRuleTargets(req.Targets)
+	}
+	if req.ResolveRecipient != nil {
+		rule.ResolveRecipient = *req.ResolveRecipient
+	}
+	// Accounts are replaced only when the request includes them
+	replaceAccounts := req.AccountIDs != nil
+	if replaceAccounts {
+		rule.Accounts = newRuleAccounts(req.AccountIDs)
+	}
+	if req.SubjectTemplate != nil {
+		rule.SubjectTemplate = *req.SubjectTemplate
+	}
+	if req.HeaderTemplate != nil {
+		rule.HeaderTemplate = *req.HeaderTemplate
+	}
+	if req.FooterTemplate != nil {
+		rule.FooterTemplate = *req.FooterTemplate
+	}
+	if req.DeliveryMode != "" {
+		rule.DeliveryMode = req.DeliveryMode
+	}
+	if req.Priority != nil {
+		rule.Priority = *req.Priority
+	}
+	if req.Continue != nil {
+		rule.Continue = *req.Continue
+	}
+	if req.OrderedDelivery != nil {
+		rule.OrderedDelivery = *req.OrderedDelivery
+	}
 	if req.Enabled != nil {
 		rule.Enabled = *req.Enabled
 	}
 
-	if err := h.db.Save(&rule).Error; err != nil {
+	if err := h.validateRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if !h.checkRuleAccounts(c, req.AccountIDs) {
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Conditions", "Targets", "Accounts").Save(&rule).Error; err != nil {
+			return err
+		}
+		if replaceConditions {
+			if err := tx.Where("rule_id = ?", rule.ID).Delete(&model.RuleCondition{}).Error; err != nil {
+				return err
+			}
+			for i := range rule.Conditions {
+				rule.Conditions[i].RuleID = rule.ID
+			}
+			if len(rule.Conditions) > 0 {
+				if err := tx.Create(&rule.Conditions).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if replaceTargets {
+			if err := tx.Where("rule_id = ?", rule.ID).Delete(&model.RuleTarget{}).Error; err != nil {
+				return err
+			}
+			for i := range rule.Targets {
+				rule.Targets[i].RuleID = rule.ID
+			}
+			if len(rule.Targets) > 0 {
+				if err := tx.Create(&rule.Targets).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if replaceAccounts {
+			if err := tx.Where("rule_id = ?", rule.ID).Delete(&model.RuleAccount{}).Error; err != nil {
+				return err
+			}
+			for i := range rule.Accounts {
+				rule.Accounts[i].RuleID = rule.ID
+			}
+			if len(rule.Accounts) > 0 {
+				if err := tx.Create(&rule.Accounts).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Error:   "database_error",
 			Message: "Failed to update rule",
@@ -178,18 +315,85 @@ func (h *Handlers) UpdateRule(c *gin.Context) {
 		return
 	}
 
-	response := ForwardRuleResponse{
-		ID:          rule.ID,
-		Keyword:     rule.Keyword,
-		TargetEmail: rule.TargetEmail,
-		Enabled:     rule.Enabled,
-		CreatedAt:   rule.CreatedAt,
-		UpdatedAt:   rule.UpdatedAt,
-	}
+	response := newForwardRuleResponse(&rule)
 
 	c.JSON(http.StatusOK, response)
 }
 
+// PreviewRule renders the subject and body a rule's templates produce for a
+// sample email. Fields of the sample can be overridden in the request body.
+func (h *Handlers) PreviewRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid rule ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var req RulePreviewRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "Invalid request body",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+	}
+
+	var rule model.ForwardRule
+	if err := h.db.Preload("Conditions").Preload("Targets").First(&rule, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, ErrorResponse{
+				Error:   "not_found",
+				Message: "Rule not found",
+				Code:    http.StatusNotFound,
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch rule",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	sample := service.SampleEmail(&rule)
+	if req.Subject != "" {
+		sample.Subject = req.Subject
+	}
+	if req.From != "" {
+		sample.From = req.From
+	}
+	if req.To != nil {
+		sample.To = req.To
+	}
+	if req.Cc != nil {
+		sample.CC = req.Cc
+	}
+	if req.Body != "" || req.HTMLBody != "" {
+		sample.Body = req.Body
+		sample.HTMLBody = req.HTMLBody
+	}
+
+	preview, err := h.parser.PreviewForward(&rule, sample)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{
+			Error:   "template_error",
+			Message: err.Error(),
+			Code:    http.StatusUnprocessableEntity,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, preview)
+}
+
 // DeleteRule deletes a forwarding rule
 func (h *Handlers) DeleteRule(c *gin.Context) {
 	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
@@ -261,3 +465,139 @@ func (h *Handlers) DisableRule(c *gin.Context) {
 
 	c.Status(http.StatusNoContent)
 }
+
+// newRuleConditions converts request conditions into rule conditions,
+// defaulting the operator to equals
+func newRuleConditions(reqs []RuleConditionRequest) []model.RuleCondition {
+	conditions := make([]model.RuleCondition, 0, len(reqs))
+	for _, req := range reqs {
+		operator := model.ConditionOpEquals
+		if req.Operator != "" {
+			operator = req.Operator
+		}
+
+		conditions = append(conditions, model.RuleCondition{
+			Field:    req.Field,
+			Header:   req.Header,
+			Operator: operator,
+			Value:    req.Value,
+		})
+	}
+	return conditions
+}
+
+// newRuleTargets converts request targets into rule targets, defaulting the
+// role to to
+func newRuleTargets(reqs []RuleTargetRequest) []model.RuleTarget {
+	targets := make([]model.RuleTarget, 0, len(reqs))
+	for _, req := range reqs {
+		role := model.RecipientRoleTo
+		if req.Role != "" {
+			role = req.Role
+		}
+
+		targets = append(targets, model.RuleTarget{
+			Email: req.Email,
+			Role:  role,
+		})
+	}
+	return targets
+}
+
+// newRuleAccounts converts the mail account IDs of a rule request into rule
+// accounts, dropping repeated IDs
+func newRuleAccounts(ids []uint) []model.RuleAccount {
+	accounts := make([]model.RuleAccount, 0, len(ids))
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		accounts = append(accounts, model.RuleAccount{AccountID: id})
+	}
+	return accounts
+}
+
+// checkRuleAccounts checks that the mail accounts a rule is scoped to exist,
+// writing the error response if not. Account 0 is the mailbox of the config
+// file.
+func (h *Handlers) checkRuleAccounts(c *gin.Context, ids []uint) bool {
+	unknown := make(map[uint]bool)
+	for _, id := range ids {
+		if id != 0 {
+			unknown[id] = true
+		}
+	}
+	if len(unknown) == 0 {
+		return true
+	}
+
+	var found []uint
+	if err := h.db.Model(&model.MailAccount{}).Where("id IN ?", ids).Pluck("id", &found).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error:   "database_error",
+			Message: "Failed to fetch mail accounts",
+			Code:    http.StatusInternalServerError,
+		})
+		return false
+	}
+	for _, id := range found {
+		delete(unknown, id)
+	}
+
+	for id := range unknown {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error:   "validation_error",
+			Message: fmt.Sprintf("mail account %d does not exist", id),
+			Code:    http.StatusBadRequest,
+		})
+		return false
+	}
+	return true
+}
+
+// validateRule checks the keyword pattern, conditions, recipients and
+// delivery mode of a rule
+func (h *Handlers) validateRule(rule *model.ForwardRule) error {
+	if rule.Keyword == "" && len(rule.Conditions) == 0 {
+		return errors.New("rule requires a keyword or at least one condition")
+	}
+
+	if rule.TargetEmail == "" && len(rule.Targets) == 0 && !rule.ResolveRecipient {
+		return errors.New("rule requires a target_email, at least one target or resolve_recipient")
+	}
+
+	// target_email is optional in updates, so it is validated here rather
+	// than by the request binding
+	if rule.TargetEmail != "" {
+		address, err := mail.ParseAddress(rule.TargetEmail)
+		if err != nil || address.Address != rule.TargetEmail {
+			return fmt.Errorf("invalid target_email %q", rule.TargetEmail)
+		}
+	}
+
+	if rule.DeliveryMode == model.DeliveryModeRedirect && !h.smtpEnabled {
+		return errors.New("redirect delivery mode requires SMTP forwarding")
+	}
+
+	if err := service.ValidateKeywordPattern(rule.MatchType, rule.Keyword); err != nil {
+		return err
+	}
+
+	for i := range rule.Conditions {
+		if err := service.ValidateCondition(&rule.Conditions[i]); err != nil {
+			return err
+		}
+	}
+
+	return service.ValidateTemplates(service.RuleTemplates(rule))
+}
+
+// stringValue returns the value of an optional string, or "" if it is nil
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
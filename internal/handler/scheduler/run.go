@@ -1,16 +1,72 @@
 package scheduler
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	schedulerSvc "smart-mail-relay-go/internal/service/scheduler"
 )
 
-// RunOnce runs the email processing once
+// RunOnce starts a processing cycle of a mail account in the background and
+// returns its run ID. The account is given by the account_id query parameter
+// and defaults to the mailbox of the config file. If a cycle of the account is
+// already in progress the request returns the ID of that run, or fails with
+// 409 Conflict when called with if_running=reject.
 func RunOnce(s *schedulerSvc.Scheduler) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if err := s.RunOnce(); err != nil {
+		accountID, err := strconv.ParseUint(c.DefaultQuery("account_id", "0"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "Invalid account_id",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		ifRunning := c.DefaultQuery("if_running", "join")
+		if ifRunning != "join" && ifRunning != "reject" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "if_running must be join or reject",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		runID, joined, err := s.RunOnce(uint(accountID), ifRunning == "join")
+		switch {
+		case errors.Is(err, schedulerSvc.ErrUnknownAccount):
+			c.JSON(http.StatusNotFound, ErrorResponse{
+				Error:   "not_found",
+				Message: "Mail account not found or disabled",
+				Code:    http.StatusNotFound,
+			})
+			return
+		case errors.Is(err, schedulerSvc.ErrCycleActive):
+			c.JSON(http.StatusConflict, ErrorResponse{
+				Error:   "cycle_active",
+				Message: "A processing cycle of this account is already in progress",
+				Code:    http.StatusConflict,
+			})
+			return
+		case errors.Is(err, schedulerSvc.ErrNotLeader):
+			c.JSON(http.StatusConflict, ErrorResponse{
+				Error:   "not_leader",
+				Message: "This instance is not the scheduler leader; send the request to the leader shown in the scheduler status",
+				Code:    http.StatusConflict,
+			})
+			return
+		case errors.Is(err, schedulerSvc.ErrNotRunning):
+			c.JSON(http.StatusConflict, ErrorResponse{
+				Error:   "scheduler_stopped",
+				Message: "The scheduler is not running",
+				Code:    http.StatusConflict,
+			})
+			return
+		case err != nil:
 			c.JSON(http.StatusInternalServerError, ErrorResponse{
 				Error:   "scheduler_error",
 				Message: "Failed to run email processing",
@@ -19,8 +75,72 @@ func RunOnce(s *schedulerSvc.Scheduler) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Email processing completed successfully",
+		message := "Email processing started"
+		if joined {
+			message = "Joined the processing cycle in progress"
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": message,
+			"run_id":  runID,
+			"joined":  joined,
 		})
 	}
 }
+
+// GetRuns returns the processing cycles in the run history, most recent first
+func GetRuns(s *schedulerSvc.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		runs, err := s.ListRuns()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{
+				Error:   "database_error",
+				Message: "Failed to fetch runs",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		responses := make([]RunResponse, 0, len(runs))
+		for _, run := range runs {
+			responses = append(responses, newRunResponse(&run))
+		}
+
+		c.JSON(http.StatusOK, responses)
+	}
+}
+
+// GetRun returns the state and progress of a processing cycle
+func GetRun(s *schedulerSvc.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "invalid_id",
+				Message: "Invalid run ID",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		run, err := s.GetRun(uint(id))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{
+				Error:   "database_error",
+				Message: "Failed to fetch run",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+		if run == nil {
+			c.JSON(http.StatusNotFound, ErrorResponse{
+				Error:   "not_found",
+				Message: "Run not found",
+				Code:    http.StatusNotFound,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, newRunResponse(run))
+	}
+}
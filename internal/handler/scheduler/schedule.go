@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	schedulerSvc "smart-mail-relay-go/internal/service/scheduler"
+)
+
+// Reschedule replaces the cron schedule of the processing cycles without
+// restarting the service. The schedule is stored, so every replica applies
+// it.
+func Reschedule(s *schedulerSvc.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ScheduleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: "Invalid request body",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+
+		err := s.Reschedule(req.Cron)
+		if errors.Is(err, schedulerSvc.ErrInvalidSchedule) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error:   "validation_error",
+				Message: err.Error(),
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{
+				Error:   "scheduler_error",
+				Message: "Failed to reschedule email processing",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Schedule updated",
+			"schedule": s.Schedule(),
+			"next_run": s.GetNextRun(),
+		})
+	}
+}
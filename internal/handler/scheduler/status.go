@@ -15,10 +15,26 @@ func Status(s *schedulerSvc.Scheduler) gin.HandlerFunc {
 			state = "running"
 		}
 
+		leader, err := s.Leader()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{
+				Error:   "database_error",
+				Message: "Failed to fetch scheduler leader",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{
-			"status":   state,
-			"next_run": s.GetNextRun(),
-			"last_run": s.GetLastRun(),
+			"status":        state,
+			"schedule":      s.Schedule(),
+			"next_run":      s.GetNextRun(),
+			"last_run":      s.GetLastRun(),
+			"active_cycles": s.ActiveCycles(),
+			"instance_id":   s.InstanceID(),
+			"is_leader":     s.IsLeader(),
+			"leader":        leader,
+			"accounts":      s.Accounts(),
 		})
 	}
 }
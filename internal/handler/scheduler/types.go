@@ -1,8 +1,59 @@
 package scheduler
 
+import (
+	"time"
+
+	"smart-mail-relay-go/internal/model"
+)
+
 // ErrorResponse represents an error response
 type ErrorResponse struct {
 	Error   string `json:"error"`
 	Message string `json:"message"`
 	Code    int    `json:"code"`
 }
+
+// ScheduleRequest represents the request structure for rescheduling the
+// processing cycles
+type ScheduleRequest struct {
+	Cron string `json:"cron" binding:"required"`
+}
+
+// RunResponse represents the state and progress of a processing cycle
+type RunResponse struct {
+	ID         uint       `json:"id"`
+	AccountID  uint       `json:"account_id"`
+	Trigger    string     `json:"trigger"`
+	State      string     `json:"state"`
+	Fetched    int        `json:"fetched"`
+	Matched    int        `json:"matched"`
+	Forwarded  int        `json:"forwarded"`
+	Failed     int        `json:"failed"`
+	Errors     []string   `json:"errors"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	DurationMs int64      `json:"duration_ms"`
+}
+
+// newRunResponse converts a scheduler run into its response structure
+func newRunResponse(run *model.SchedulerRun) RunResponse {
+	errs := run.Errors
+	if errs == nil {
+		errs = []string{}
+	}
+
+	return RunResponse{
+		ID:         run.ID,
+		AccountID:  run.AccountID,
+		Trigger:    run.Trigger,
+		State:      run.State,
+		Fetched:    run.Fetched,
+		Matched:    run.Matched,
+		Forwarded:  run.Forwarded,
+		Failed:     run.Failed,
+		Errors:     errs,
+		StartedAt:  run.StartedAt,
+		FinishedAt: run.FinishedAt,
+		DurationMs: run.Duration().Milliseconds(),
+	}
+}
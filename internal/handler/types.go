@@ -1,33 +1,315 @@
 package handler
 
-import "time"
+import (
+	"time"
+
+	"smart-mail-relay-go/internal/model"
+)
 
 // ForwardRuleRequest represents the request structure for creating/updating forward rules
+//
+// A rule needs a keyword, at least one condition, or both, and a target_email,
+// at least one target or resolve_recipient. account_ids scopes the rule to
+// mail accounts, where 0 is the mailbox of the config file; without accounts
+// the rule applies to every mailbox. An update leaves the fields it does not
+// include unchanged; an empty target_email clears it.
 type ForwardRuleRequest struct {
-	Keyword     string `json:"keyword" binding:"required"`
-	TargetEmail string `json:"target_email" binding:"required,email"`
-	Enabled     *bool  `json:"enabled"`
+	Keyword          *string                `json:"keyword"`
+	MatchType        string                 `json:"match_type" binding:"omitempty,oneof=exact prefix glob regex"`
+	ConditionLogic   string                 `json:"condition_logic" binding:"omitempty,oneof=and or"`
+	Conditions       []RuleConditionRequest `json:"conditions" binding:"omitempty,dive"`
+	Priority         *int                   `json:"priority"`
+	Continue         *bool                  `json:"continue"`
+	TargetEmail      *string                `json:"target_email"`
+	Targets          []RuleTargetRequest    `json:"targets" binding:"omitempty,dive"`
+	AccountIDs       []uint                 `json:"account_ids"`
+	ResolveRecipient *bool                  `json:"resolve_recipient"`
+	DeliveryMode     string                 `json:"delivery_mode" binding:"omitempty,oneof=inline attachment redirect"`
+	SubjectTemplate  *string                `json:"subject_template" binding:"omitempty,max=1024"`
+	HeaderTemplate   *string                `json:"header_template"`
+	FooterTemplate   *string                `json:"footer_template"`
+	OrderedDelivery  *bool                  `json:"ordered_delivery"`
+	Enabled          *bool                  `json:"enabled"`
+}
+
+// RuleConditionRequest represents a match condition in a forward rule request
+type RuleConditionRequest struct {
+	Field    string `json:"field" binding:"required,oneof=from from_domain to cc header body"`
+	Header   string `json:"header"`
+	Operator string `json:"operator" binding:"omitempty,oneof=equals contains regex"`
+	Value    string `json:"value" binding:"required"`
+}
+
+// RuleTargetRequest represents a recipient in a forward rule request
+type RuleTargetRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role" binding:"omitempty,oneof=to cc bcc"`
 }
 
 // ForwardRuleResponse represents the response structure for forward rules
 type ForwardRuleResponse struct {
+	ID               uint                    `json:"id"`
+	Keyword          string                  `json:"keyword"`
+	MatchType        string                  `json:"match_type"`
+	ConditionLogic   string                  `json:"condition_logic"`
+	Conditions       []RuleConditionResponse `json:"conditions"`
+	Priority         int                     `json:"priority"`
+	Continue         bool                    `json:"continue"`
+	TargetEmail      string                  `json:"target_email"`
+	Targets          []RuleTargetResponse    `json:"targets"`
+	AccountIDs       []uint                  `json:"account_ids"`
+	ResolveRecipient bool                    `json:"resolve_recipient"`
+	DeliveryMode     string                  `json:"delivery_mode"`
+	SubjectTemplate  string                  `json:"subject_template,omitempty"`
+	HeaderTemplate   string                  `json:"header_template,omitempty"`
+	FooterTemplate   string                  `json:"footer_template,omitempty"`
+	OrderedDelivery  bool                    `json:"ordered_delivery"`
+	Enabled          bool                    `json:"enabled"`
+	CreatedAt        time.Time               `json:"created_at"`
+	UpdatedAt        time.Time               `json:"updated_at"`
+}
+
+// RuleConditionResponse represents the response structure for rule conditions
+type RuleConditionResponse struct {
+	ID       uint   `json:"id"`
+	Field    string `json:"field"`
+	Header   string `json:"header,omitempty"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// RuleTargetResponse represents the response structure for rule targets
+type RuleTargetResponse struct {
+	ID    uint   `json:"id"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// newForwardRuleResponse converts a forwarding rule into its response structure
+func newForwardRuleResponse(rule *model.ForwardRule) ForwardRuleResponse {
+	conditions := make([]RuleConditionResponse, 0, len(rule.Conditions))
+	for _, cond := range rule.Conditions {
+		conditions = append(conditions, RuleConditionResponse{
+			ID:       cond.ID,
+			Field:    cond.Field,
+			Header:   cond.Header,
+			Operator: cond.Operator,
+			Value:    cond.Value,
+		})
+	}
+
+	targets := make([]RuleTargetResponse, 0, len(rule.Targets))
+	for _, target := range rule.Targets {
+		targets = append(targets, RuleTargetResponse{
+			ID:    target.ID,
+			Email: target.Email,
+			Role:  target.Role,
+		})
+	}
+
+	accountIDs := make([]uint, 0, len(rule.Accounts))
+	for _, account := range rule.Accounts {
+		accountIDs = append(accountIDs, account.AccountID)
+	}
+
+	return ForwardRuleResponse{
+		ID:               rule.ID,
+		Keyword:          rule.Keyword,
+		MatchType:        rule.MatchType,
+		ConditionLogic:   rule.ConditionLogic,
+		Conditions:       conditions,
+		Priority:         rule.Priority,
+		Continue:         rule.Continue,
+		TargetEmail:      rule.TargetEmail,
+		Targets:          targets,
+		AccountIDs:       accountIDs,
+		ResolveRecipient: rule.ResolveRecipient,
+		DeliveryMode:     rule.DeliveryMode,
+		SubjectTemplate:  rule.SubjectTemplate,
+		HeaderTemplate:   rule.HeaderTemplate,
+		FooterTemplate:   rule.FooterTemplate,
+		OrderedDelivery:  rule.OrderedDelivery,
+		Enabled:          rule.Enabled,
+		CreatedAt:        rule.CreatedAt,
+		UpdatedAt:        rule.UpdatedAt,
+	}
+}
+
+// RulePreviewRequest overrides fields of the sample email used to preview the
+// templates of a rule
+type RulePreviewRequest struct {
+	Subject  string   `json:"subject"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Cc       []string `json:"cc"`
+	Body     string   `json:"body"`
+	HTMLBody string   `json:"html_body"`
+}
+
+// ForwardLogResponse represents the response structure for forward logs
+type ForwardLogResponse struct {
+	ID         uint                          `json:"id"`
+	AccountID  uint                          `json:"account_id"`
+	MessageID  string                        `json:"message_id"`
+	RuleID     *uint                         `json:"rule_id"`
+	Status     string                        `json:"status"`
+	ErrorMsg   string                        `json:"error_msg"`
+	CreatedAt  time.Time                     `json:"created_at"`
+	Rule       *ForwardRuleResponse          `json:"rule,omitempty"`
+	Recipients []ForwardLogRecipientResponse `json:"recipients,omitempty"`
+}
+
+// ForwardLogRecipientResponse represents the delivery status of one recipient
+// in a forward log
+type ForwardLogRecipientResponse struct {
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Status   string `json:"status"`
+	ErrorMsg string `json:"error_msg,omitempty"`
+}
+
+// newForwardLogResponse converts a forward log into its response structure
+func newForwardLogResponse(log *model.ForwardLog) ForwardLogResponse {
+	response := ForwardLogResponse{
+		ID:        log.ID,
+		AccountID: log.AccountID,
+		MessageID: log.MessageID,
+		RuleID:    log.RuleID,
+		Status:    log.Status,
+		ErrorMsg:  log.ErrorMsg,
+		CreatedAt: log.CreatedAt,
+	}
+
+	if log.Rule != nil {
+		ruleResponse := newForwardRuleResponse(log.Rule)
+		response.Rule = &ruleResponse
+	}
+
+	for _, recipient := range log.Recipients {
+		response.Recipients = append(response.Recipients, ForwardLogRecipientResponse{
+			Email:    recipient.Email,
+			Role:     recipient.Role,
+			Status:   recipient.Status,
+			ErrorMsg: recipient.ErrorMsg,
+		})
+	}
+
+	return response
+}
+
+// OutboxJobResponse represents the response structure for outbox jobs
+type OutboxJobResponse struct {
+	ID            uint       `json:"id"`
+	AccountID     uint       `json:"account_id"`
+	MessageID     string     `json:"message_id"`
+	RuleID        uint       `json:"rule_id"`
+	Subject       string     `json:"subject"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	ClaimedAt     *time.Time `json:"claimed_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// newOutboxJobResponse converts an outbox job into its response structure
+func newOutboxJobResponse(job *model.OutboxJob) OutboxJobResponse {
+	return OutboxJobResponse{
+		ID:            job.ID,
+		AccountID:     job.AccountID,
+		MessageID:     job.MessageID,
+		RuleID:        job.RuleID,
+		Subject:       job.Subject,
+		Status:        job.Status,
+		Attempts:      job.Attempts,
+		NextAttemptAt: job.NextAttemptAt,
+		ClaimedAt:     job.ClaimedAt,
+		LastError:     job.LastError,
+		CreatedAt:     job.CreatedAt,
+		UpdatedAt:     job.UpdatedAt,
+	}
+}
+
+// ContactRequest represents the request structure for creating/updating contacts
+type ContactRequest struct {
+	Name  string `json:"name" binding:"required"`
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ContactResponse represents the response structure for contacts
+type ContactResponse struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newContactResponse converts a contact into its response structure
+func newContactResponse(contact *model.Contact) ContactResponse {
+	return ContactResponse{
+		ID:        contact.ID,
+		Name:      contact.Name,
+		Email:     contact.Email,
+		CreatedAt: contact.CreatedAt,
+		UpdatedAt: contact.UpdatedAt,
+	}
+}
+
+// AccountRequest represents the request structure for creating/updating mail
+// accounts. Secrets left empty on update keep their stored value.
+type AccountRequest struct {
+	Name         string `json:"name" binding:"required,max=100"`
+	Email        string `json:"email" binding:"required,email"`
+	FetchMethod  string `json:"fetch_method" binding:"omitempty,oneof=gmail_api imap"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	IMAPHost     string `json:"imap_host"`
+	IMAPPort     int    `json:"imap_port" binding:"omitempty,min=1,max=65535"`
+	IMAPUser     string `json:"imap_user"`
+	IMAPPassword string `json:"imap_password"`
+	IMAPIdle     bool   `json:"imap_idle"`
+	Cron         string `json:"cron"`
+	Enabled      *bool  `json:"enabled"`
+}
+
+// AccountResponse represents the response structure for mail accounts. The
+// secrets of an account are never returned.
+type AccountResponse struct {
 	ID          uint      `json:"id"`
-	Keyword     string    `json:"keyword"`
-	TargetEmail string    `json:"target_email"`
+	Name        string    `json:"name"`
+	Email       string    `json:"email"`
+	FetchMethod string    `json:"fetch_method"`
+	ClientID    string    `json:"client_id,omitempty"`
+	IMAPHost    string    `json:"imap_host,omitempty"`
+	IMAPPort    int       `json:"imap_port,omitempty"`
+	IMAPUser    string    `json:"imap_user,omitempty"`
+	IMAPIdle    bool      `json:"imap_idle"`
+	Cron        string    `json:"cron"`
 	Enabled     bool      `json:"enabled"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
-// ForwardLogResponse represents the response structure for forward logs
-type ForwardLogResponse struct {
-	ID        uint                 `json:"id"`
-	MessageID string               `json:"message_id"`
-	RuleID    *uint                `json:"rule_id"`
-	Status    string               `json:"status"`
-	ErrorMsg  string               `json:"error_msg"`
-	CreatedAt time.Time            `json:"created_at"`
-	Rule      *ForwardRuleResponse `json:"rule,omitempty"`
+// newAccountResponse converts a mail account into its response structure
+func newAccountResponse(account *model.MailAccount) AccountResponse {
+	return AccountResponse{
+		ID:          account.ID,
+		Name:        account.Name,
+		Email:       account.Email,
+		FetchMethod: account.FetchMethod,
+		ClientID:    account.ClientID,
+		IMAPHost:    account.IMAPHost,
+		IMAPPort:    account.IMAPPort,
+		IMAPUser:    account.IMAPUser,
+		IMAPIdle:    account.IMAPIdle,
+		Cron:        account.Cron,
+		Enabled:     account.Enabled,
+		CreatedAt:   account.CreatedAt,
+		UpdatedAt:   account.UpdatedAt,
+	}
 }
 
 // HealthResponse represents the health check response
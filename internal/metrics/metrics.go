@@ -11,6 +11,9 @@ type Metrics struct {
 	MatchCount       prometheus.Counter
 	ForwardSuccesses prometheus.Counter
 	ForwardFailures  prometheus.Counter
+	FetchFailures    prometheus.Counter
+	FetchCircuitOpen *prometheus.GaugeVec
+	DeadLetters      prometheus.Counter
 	ProcessingTime   prometheus.Histogram
 	ActiveRules      prometheus.Gauge
 	TotalRules       prometheus.Gauge
@@ -35,6 +38,18 @@ func NewMetrics() *Metrics {
 			Name: "smart_mail_relay_forward_failures",
 			Help: "Total number of failed email forwards",
 		}),
+		FetchFailures: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "smart_mail_relay_fetch_failures",
+			Help: "Total number of failed email fetch operations",
+		}),
+		FetchCircuitOpen: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "smart_mail_relay_fetch_circuit_open",
+			Help: "Whether fetching a mail account is stopped by the circuit breaker after consecutive failures (1) or not (0)",
+		}, []string{"account"}),
+		DeadLetters: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "smart_mail_relay_dead_letters",
+			Help: "Total number of forwards moved to the dead letter state after exhausting their retries",
+		}),
 		ProcessingTime: promauto.NewHistogram(prometheus.HistogramOpts{
 			Name:    "smart_mail_relay_processing_duration_seconds",
 			Help:    "Time spent processing emails",
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// Contact is an address book entry used to resolve the recipient name
+// extracted from a subject to an email address
+type Contact struct {
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string    `json:"name" gorm:"type:varchar(255);not null;uniqueIndex"`
+	Email     string    `json:"email" gorm:"type:varchar(255);not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for Contact
+func (Contact) TableName() string {
+	return "contacts"
+}
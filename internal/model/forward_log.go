@@ -9,6 +9,7 @@ import (
 // ForwardLog represents a log entry for email forwarding attempts
 type ForwardLog struct {
 	ID        uint           `json:"id" gorm:"primaryKey;autoIncrement"`
+	AccountID uint           `json:"account_id" gorm:"not null;default:0;index"`
 	MessageID string         `json:"message_id" gorm:"type:varchar(255);not null;index"`
 	RuleID    *uint          `json:"rule_id" gorm:"index"`
 	Status    string         `json:"status" gorm:"type:varchar(50);not null"`
@@ -16,7 +17,24 @@ type ForwardLog struct {
 	CreatedAt time.Time      `json:"created_at"`
 	DeletedAt gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
 
-	Rule *ForwardRule `json:"rule,omitempty" gorm:"foreignKey:RuleID"`
+	Rule       *ForwardRule          `json:"rule,omitempty" gorm:"foreignKey:RuleID"`
+	Recipients []ForwardLogRecipient `json:"recipients,omitempty" gorm:"foreignKey:ForwardLogID"`
+}
+
+// ForwardLogRecipient records the delivery status of one recipient of a
+// forwarding attempt
+type ForwardLogRecipient struct {
+	ID           uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	ForwardLogID uint   `json:"forward_log_id" gorm:"not null;index"`
+	Email        string `json:"email" gorm:"type:varchar(255);not null"`
+	Role         string `json:"role" gorm:"type:varchar(3);not null"`
+	Status       string `json:"status" gorm:"type:varchar(50);not null"`
+	ErrorMsg     string `json:"error_msg" gorm:"type:text"`
+}
+
+// TableName specifies the table name for ForwardLogRecipient
+func (ForwardLogRecipient) TableName() string {
+	return "forward_log_recipients"
 }
 
 // TableName specifies the table name for ForwardLog
@@ -6,15 +6,73 @@ import (
 	"gorm.io/gorm"
 )
 
+// Delivery modes of a forwarding rule
+const (
+	// DeliveryModeInline forwards the email as a new "Fwd:" message with the
+	// original content inlined
+	DeliveryModeInline = "inline"
+	// DeliveryModeAttachment forwards the untouched original message as a
+	// message/rfc822 attachment
+	DeliveryModeAttachment = "attachment"
+	// DeliveryModeRedirect resends the original message unchanged apart from
+	// added Resent-* headers, so replies go to the original sender
+	DeliveryModeRedirect = "redirect"
+)
+
+// Keyword match types of a forwarding rule
+const (
+	// MatchTypeExact matches keywords equal to the rule keyword, ignoring case
+	MatchTypeExact = "exact"
+	// MatchTypePrefix matches keywords starting with the rule keyword, ignoring case
+	MatchTypePrefix = "prefix"
+	// MatchTypeGlob matches keywords against a shell-style pattern (*, ?, [...]), ignoring case
+	MatchTypeGlob = "glob"
+	// MatchTypeRegex matches keywords against a Go regular expression
+	MatchTypeRegex = "regex"
+)
+
 // ForwardRule represents a forwarding rule in the database
+//
+// An empty Keyword matches any subject, in which case the rule is selected by
+// its Conditions alone. Matching rules are applied in ascending Priority; a
+// rule stops further rules from being applied unless Continue is set.
+//
+// TargetEmail, when set, is the primary To recipient; Targets adds further
+// To, Cc and Bcc recipients of the same message. A rule with ResolveRecipient
+// set only matches when the recipient name in the subject is found in the
+// contacts, and the contact's address is added as the first To recipient.
+//
+// SubjectTemplate, HeaderTemplate and FooterTemplate are Go templates that
+// replace the default "Fwd:" subject and "Forwarded message" block and add a
+// footer to inline and attachment forwards.
+//
+// A rule with Accounts only applies to the emails fetched from those mail
+// accounts; without, it applies to every mailbox.
+//
+// With OrderedDelivery set, the forwards of the rule are sent one at a time in
+// the order the emails were queued, and a forward waiting for a retry holds
+// back the later ones.
 type ForwardRule struct {
-	ID          uint           `json:"id" gorm:"primaryKey;autoIncrement"`
-	Keyword     string         `json:"keyword" gorm:"type:varchar(255);not null;uniqueIndex"`
-	TargetEmail string         `json:"target_email" gorm:"type:varchar(255);not null"`
-	Enabled     bool           `json:"enabled" gorm:"default:true"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
+	ID               uint            `json:"id" gorm:"primaryKey;autoIncrement"`
+	Keyword          string          `json:"keyword" gorm:"type:varchar(255);not null;index"`
+	MatchType        string          `json:"match_type" gorm:"type:varchar(20);not null;default:exact"`
+	ConditionLogic   string          `json:"condition_logic" gorm:"type:varchar(3);not null;default:and"`
+	Conditions       []RuleCondition `json:"conditions,omitempty" gorm:"foreignKey:RuleID"`
+	Priority         int             `json:"priority" gorm:"not null;default:0;index"`
+	Continue         bool            `json:"continue" gorm:"not null;default:false"`
+	TargetEmail      string          `json:"target_email" gorm:"type:varchar(255);not null"`
+	Targets          []RuleTarget    `json:"targets,omitempty" gorm:"foreignKey:RuleID"`
+	ResolveRecipient bool            `json:"resolve_recipient" gorm:"not null;default:false"`
+	DeliveryMode     string          `json:"delivery_mode" gorm:"type:varchar(20);not null;default:inline"`
+	SubjectTemplate  string          `json:"subject_template" gorm:"type:varchar(1024)"`
+	HeaderTemplate   string          `json:"header_template" gorm:"type:text"`
+	FooterTemplate   string          `json:"footer_template" gorm:"type:text"`
+	OrderedDelivery  bool            `json:"ordered_delivery" gorm:"not null;default:false"`
+	Accounts         []RuleAccount   `json:"accounts,omitempty" gorm:"foreignKey:RuleID"`
+	Enabled          bool            `json:"enabled" gorm:"default:true"`
+	CreatedAt        time.Time       `json:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+	DeletedAt        gorm.DeletedAt  `json:"deleted_at,omitempty" gorm:"index"`
 }
 
 // TableName specifies the table name for ForwardRule
@@ -0,0 +1,45 @@
+package model
+
+import "time"
+
+// Fetch methods of a mail account
+const (
+	// FetchMethodGmailAPI fetches the account through the Gmail API
+	FetchMethodGmailAPI = "gmail_api"
+	// FetchMethodIMAP fetches the INBOX of the account over IMAP
+	FetchMethodIMAP = "imap"
+)
+
+// MailAccount is a mailbox fetched by its own pipeline, with its own
+// credentials, fetch method and schedule, next to the mailbox configured in
+// the config file. Rules scoped to accounts only apply to the emails fetched
+// from them.
+//
+// Cron is the schedule of the account's processing cycles in the formats of
+// scheduler.cron; empty follows the scheduler schedule. The secrets are
+// encrypted at rest by SecretSerializer.
+type MailAccount struct {
+	ID          uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name        string `json:"name" gorm:"type:varchar(100);not null;uniqueIndex"`
+	Email       string `json:"email" gorm:"type:varchar(255);not null"`
+	FetchMethod string `json:"fetch_method" gorm:"type:varchar(20);not null;default:gmail_api"`
+	// Gmail API credentials
+	ClientID     string `json:"client_id" gorm:"type:varchar(255)"`
+	ClientSecret string `json:"-" gorm:"type:varchar(512);serializer:secret"`
+	RefreshToken string `json:"-" gorm:"type:varchar(2048);serializer:secret"`
+	// IMAP server and credentials
+	IMAPHost     string    `json:"imap_host" gorm:"type:varchar(255)"`
+	IMAPPort     int       `json:"imap_port"`
+	IMAPUser     string    `json:"imap_user" gorm:"type:varchar(255)"`
+	IMAPPassword string    `json:"-" gorm:"type:varchar(512);serializer:secret"`
+	IMAPIdle     bool      `json:"imap_idle" gorm:"not null;default:false"`
+	Cron         string    `json:"cron" gorm:"type:varchar(255)"`
+	Enabled      bool      `json:"enabled" gorm:"default:true"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for MailAccount
+func (MailAccount) TableName() string {
+	return "mail_accounts"
+}
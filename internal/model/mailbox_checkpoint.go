@@ -0,0 +1,27 @@
+package model
+
+import (
+	"time"
+)
+
+// MailboxCheckpoint stores incremental sync progress for a fetched mailbox.
+// Checkpoints belong to a mail account, 0 being the mailbox in the config
+// file.
+type MailboxCheckpoint struct {
+	ID          uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	AccountID   uint      `json:"account_id" gorm:"not null;default:0;uniqueIndex:idx_account_checkpoint"`
+	Account     string    `json:"account" gorm:"type:varchar(255);not null;uniqueIndex:idx_account_checkpoint"`
+	Mailbox     string    `json:"mailbox" gorm:"type:varchar(255);not null;uniqueIndex:idx_account_checkpoint"`
+	UIDValidity uint32    `json:"uid_validity"`
+	LastUID     uint32    `json:"last_uid"`
+	HistoryID   uint64    `json:"history_id"`
+	SyncQuery   string    `json:"sync_query" gorm:"type:varchar(255)"`
+	PageToken   string    `json:"page_token" gorm:"type:varchar(255)"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for MailboxCheckpoint
+func (MailboxCheckpoint) TableName() string {
+	return "mailbox_checkpoints"
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"time"
+)
+
+// Outbox job states
+const (
+	OutboxStatusPending    = "pending"
+	OutboxStatusProcessing = "processing"
+	OutboxStatusSent       = "sent"
+	OutboxStatusDead       = "dead"
+)
+
+// OutboxJob is a queued forward of one email by one rule. Jobs are retried
+// with exponential backoff until they are sent or run out of attempts, after
+// which they stay in the dead state until retried or dropped. A job is
+// claimed, moving it to the processing state, before every attempt.
+type OutboxJob struct {
+	ID            uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	AccountID     uint      `json:"account_id" gorm:"not null;default:0;uniqueIndex:idx_outbox_account_job"`
+	MessageID     string    `json:"message_id" gorm:"type:varchar(255);not null;uniqueIndex:idx_outbox_account_job"`
+	RuleID        uint      `json:"rule_id" gorm:"not null;uniqueIndex:idx_outbox_account_job"`
+	Subject       string    `json:"subject" gorm:"type:varchar(1024)"`
+	Status        string    `json:"status" gorm:"type:varchar(20);not null;default:pending;index:idx_outbox_due"`
+	Attempts      int       `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt time.Time `json:"next_attempt_at" gorm:"index:idx_outbox_due"`
+	LastError     string    `json:"last_error" gorm:"type:text"`
+	// ClaimedAt is when the current or last attempt claimed the job
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+	// Payload holds the encoded email and recipients; it is cleared once the
+	// job has been sent
+	Payload   []byte    `json:"-" gorm:"type:longblob"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Rule *ForwardRule `json:"rule,omitempty" gorm:"foreignKey:RuleID"`
+}
+
+// TableName specifies the table name for OutboxJob
+func (OutboxJob) TableName() string {
+	return "outbox_jobs"
+}
@@ -6,10 +6,13 @@ import (
 	"gorm.io/gorm"
 )
 
-// ProcessedEmail represents a processed email to ensure idempotency
+// ProcessedEmail represents a processed email to ensure idempotency. Emails
+// are tracked per mail account; AccountID 0 is the mailbox configured in the
+// config file.
 type ProcessedEmail struct {
 	ID          uint           `json:"id" gorm:"primaryKey;autoIncrement"`
-	MessageID   string         `json:"message_id" gorm:"type:varchar(255);not null;uniqueIndex"`
+	AccountID   uint           `json:"account_id" gorm:"not null;default:0;uniqueIndex:idx_processed_email"`
+	MessageID   string         `json:"message_id" gorm:"type:varchar(255);not null;uniqueIndex:idx_processed_email"`
 	ProcessedAt time.Time      `json:"processed_at"`
 	DeletedAt   gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
 }
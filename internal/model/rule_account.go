@@ -0,0 +1,14 @@
+package model
+
+// RuleAccount scopes a forwarding rule to a mail account. A rule without
+// accounts applies to the emails of every mailbox.
+type RuleAccount struct {
+	ID        uint `json:"id" gorm:"primaryKey;autoIncrement"`
+	RuleID    uint `json:"rule_id" gorm:"not null;uniqueIndex:idx_rule_account"`
+	AccountID uint `json:"account_id" gorm:"not null;uniqueIndex:idx_rule_account;index"`
+}
+
+// TableName specifies the table name for RuleAccount
+func (RuleAccount) TableName() string {
+	return "rule_accounts"
+}
@@ -0,0 +1,54 @@
+package model
+
+import "time"
+
+// Fields a rule condition can test
+const (
+	// ConditionFieldFrom tests the sender address
+	ConditionFieldFrom = "from"
+	// ConditionFieldFromDomain tests the domain of the sender address
+	ConditionFieldFromDomain = "from_domain"
+	// ConditionFieldTo tests each To address
+	ConditionFieldTo = "to"
+	// ConditionFieldCc tests each Cc address
+	ConditionFieldCc = "cc"
+	// ConditionFieldHeader tests the value of the header named by Header
+	ConditionFieldHeader = "header"
+	// ConditionFieldBody tests the plain text body
+	ConditionFieldBody = "body"
+)
+
+// Operators of a rule condition
+const (
+	// ConditionOpEquals compares the whole value, ignoring case
+	ConditionOpEquals = "equals"
+	// ConditionOpContains looks for the value as a substring, ignoring case
+	ConditionOpContains = "contains"
+	// ConditionOpRegex matches the value as a Go regular expression
+	ConditionOpRegex = "regex"
+)
+
+// How the conditions of a rule are combined
+const (
+	// ConditionLogicAnd requires all conditions to match
+	ConditionLogicAnd = "and"
+	// ConditionLogicOr requires at least one condition to match
+	ConditionLogicOr = "or"
+)
+
+// RuleCondition is an additional match condition of a forwarding rule
+type RuleCondition struct {
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	RuleID    uint      `json:"rule_id" gorm:"not null;index"`
+	Field     string    `json:"field" gorm:"type:varchar(20);not null"`
+	Header    string    `json:"header" gorm:"type:varchar(255)"`
+	Operator  string    `json:"operator" gorm:"type:varchar(20);not null;default:equals"`
+	Value     string    `json:"value" gorm:"type:varchar(1024);not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for RuleCondition
+func (RuleCondition) TableName() string {
+	return "rule_conditions"
+}
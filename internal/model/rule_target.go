@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// Recipient roles of a rule target
+const (
+	// RecipientRoleTo lists the target in the To header
+	RecipientRoleTo = "to"
+	// RecipientRoleCc lists the target in the Cc header
+	RecipientRoleCc = "cc"
+	// RecipientRoleBcc delivers to the target without listing it in the header
+	RecipientRoleBcc = "bcc"
+)
+
+// RuleTarget is an additional recipient of a forwarding rule
+type RuleTarget struct {
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	RuleID    uint      `json:"rule_id" gorm:"not null;index"`
+	Email     string    `json:"email" gorm:"type:varchar(255);not null"`
+	Role      string    `json:"role" gorm:"type:varchar(3);not null;default:to"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for RuleTarget
+func (RuleTarget) TableName() string {
+	return "rule_targets"
+}
@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+)
+
+// SchedulerLease is a named lease held by one service instance at a time. The
+// holder renews it before ExpiresAt; once it has expired any instance may
+// take it over.
+type SchedulerLease struct {
+	Name      string    `json:"name" gorm:"primaryKey;type:varchar(100)"`
+	Holder    string    `json:"holder" gorm:"type:varchar(255);not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"type:datetime(3);not null"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for SchedulerLease
+func (SchedulerLease) TableName() string {
+	return "scheduler_leases"
+}
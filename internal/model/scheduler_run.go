@@ -0,0 +1,42 @@
+package model
+
+import (
+	"time"
+)
+
+// Scheduler run states
+const (
+	RunStateRunning   = "running"
+	RunStateCompleted = "completed"
+	RunStateFailed    = "failed"
+	RunStateCancelled = "cancelled"
+)
+
+// SchedulerRun records one email processing cycle of a mail account. Only the
+// most recent runs are kept.
+type SchedulerRun struct {
+	ID         uint       `json:"id" gorm:"primaryKey;autoIncrement"`
+	AccountID  uint       `json:"account_id" gorm:"not null;default:0;index"`
+	Trigger    string     `json:"trigger" gorm:"type:varchar(20);not null"`
+	State      string     `json:"state" gorm:"type:varchar(20);not null;index"`
+	Fetched    int        `json:"fetched"`
+	Matched    int        `json:"matched"`
+	Forwarded  int        `json:"forwarded"`
+	Failed     int        `json:"failed"`
+	Errors     []string   `json:"errors" gorm:"type:text;serializer:json"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// TableName specifies the table name for SchedulerRun
+func (SchedulerRun) TableName() string {
+	return "scheduler_runs"
+}
+
+// Duration returns how long the run took, or has been running so far
+func (r *SchedulerRun) Duration() time.Duration {
+	if r.FinishedAt == nil {
+		return time.Since(r.StartedAt)
+	}
+	return r.FinishedAt.Sub(r.StartedAt)
+}
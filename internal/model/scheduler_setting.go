@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// SchedulerSetting is a scheduler setting changed through the API. It is
+// stored so that every replica applies it, and it outlasts restarts.
+type SchedulerSetting struct {
+	Name      string    `json:"name" gorm:"primaryKey;type:varchar(100)"`
+	Value     string    `json:"value" gorm:"type:varchar(255);not null"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for SchedulerSetting
+func (SchedulerSetting) TableName() string {
+	return "scheduler_settings"
+}
@@ -0,0 +1,134 @@
+package model
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm/schema"
+)
+
+// SecretPrefix marks the values encrypted by SecretSerializer. Stored values
+// without it are plaintext written before encryption was enabled; they are
+// read as they are and encrypted when saved again.
+const SecretPrefix = "enc:v1:"
+
+// ErrSecretKeyMissing is returned when saving a secret without a key
+var ErrSecretKeyMissing = errors.New("database.secret_key is required to store mail account credentials")
+
+// secretAEAD encrypts the columns using SecretSerializer. It is set once at
+// startup, before the database is used.
+var secretAEAD cipher.AEAD
+
+func init() {
+	schema.RegisterSerializer("secret", SecretSerializer{})
+}
+
+// SetSecretKey sets the AES-256 key the columns using SecretSerializer are
+// encrypted with
+func SetSecretKey(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("invalid secret key: must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid secret key: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("invalid secret key: %w", err)
+	}
+	secretAEAD = aead
+	return nil
+}
+
+// SecretKeyConfigured reports whether secrets can be saved
+func SecretKeyConfigured() bool {
+	return secretAEAD != nil
+}
+
+// SecretSerializer encrypts string columns with AES-GCM. Each value is stored
+// as SecretPrefix followed by the base64 of a random nonce and the ciphertext;
+// empty strings are stored as they are.
+type SecretSerializer struct{}
+
+// Scan decrypts a stored secret into the field
+func (SecretSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		stored = string(v)
+	case string:
+		stored = v
+	default:
+		return fmt.Errorf("failed to read %s: unsupported type %T", field.Name, dbValue)
+	}
+
+	value, err := decryptSecret(stored)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", field.Name, err)
+	}
+	field.ReflectValueOf(ctx, dst).SetString(value)
+	return nil
+}
+
+// Value encrypts the secret in the field for storage
+func (SecretSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	value, _ := fieldValue.(string)
+	return encryptSecret(value)
+}
+
+// encryptSecret encrypts a secret with the configured key
+func encryptSecret(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if secretAEAD == nil {
+		return "", ErrSecretKeyMissing
+	}
+
+	nonce := make([]byte, secretAEAD.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := secretAEAD.Seal(nonce, nonce, []byte(value), nil)
+	return SecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret decrypts a stored secret, returning plaintext values as they
+// are
+func decryptSecret(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, SecretPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if secretAEAD == nil {
+		return "", errors.New("database.secret_key is required to read mail account credentials")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	nonceSize := secretAEAD.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("ciphertext too short")
+	}
+
+	value, err := secretAEAD.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
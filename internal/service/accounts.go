@@ -0,0 +1,99 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/config"
+	"smart-mail-relay-go/internal/model"
+)
+
+// defaultIMAPPort is the IMAP port of accounts that leave it unset
+const defaultIMAPPort = 993
+
+// AccountStore loads the mail accounts stored in the database and creates
+// their fetchers
+type AccountStore struct {
+	db          *gorm.DB
+	checkpoints *CheckpointStore
+	gmail       *config.GmailConfig
+}
+
+// NewAccountStore creates a new account store. The fetchers of the accounts
+// share the fetch limits of the Gmail configuration.
+func NewAccountStore(db *gorm.DB, checkpoints *CheckpointStore, gmail *config.GmailConfig) *AccountStore {
+	return &AccountStore{
+		db:          db,
+		checkpoints: checkpoints,
+		gmail:       gmail,
+	}
+}
+
+// Enabled returns the enabled mail accounts
+func (s *AccountStore) Enabled() ([]model.MailAccount, error) {
+	var accounts []model.MailAccount
+	if err := s.db.Where("enabled = ?", true).Order("id").Find(&accounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to get mail accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+// NewFetcher creates the fetcher of a mail account with its own credentials
+// and fetch method
+func (s *AccountStore) NewFetcher(account *model.MailAccount) (EmailFetcher, error) {
+	cfg := &config.GmailConfig{
+		ClientID:     account.ClientID,
+		ClientSecret: account.ClientSecret,
+		RefreshToken: account.RefreshToken,
+		UserEmail:    account.Email,
+		UseIMAP:      account.FetchMethod == model.FetchMethodIMAP,
+		IMAPHost:     account.IMAPHost,
+		IMAPPort:     account.IMAPPort,
+		IMAPUser:     account.IMAPUser,
+		IMAPPassword: account.IMAPPassword,
+		IMAPIdle:     account.IMAPIdle,
+	}
+	if s.gmail != nil {
+		cfg.MaxMessagesPerCycle = s.gmail.MaxMessagesPerCycle
+	}
+
+	if cfg.UseIMAP {
+		return NewIMAPFetcher(account.ID, cfg, s.checkpoints)
+	}
+	return NewGmailAPIFetcher(account.ID, cfg, s.checkpoints)
+}
+
+// ValidateAccount checks that a mail account has the credentials its fetch
+// method needs, and fills in the default fetch method and IMAP port
+func ValidateAccount(account *model.MailAccount) error {
+	account.Name = strings.TrimSpace(account.Name)
+	if account.Name == "" {
+		return errors.New("account name is required")
+	}
+	if account.Email == "" {
+		return errors.New("account email is required")
+	}
+
+	switch account.FetchMethod {
+	case "":
+		account.FetchMethod = model.FetchMethodGmailAPI
+		fallthrough
+	case model.FetchMethodGmailAPI:
+		if account.ClientID == "" || account.ClientSecret == "" || account.RefreshToken == "" {
+			return errors.New("client_id, client_secret and refresh_token are required to fetch through the Gmail API")
+		}
+	case model.FetchMethodIMAP:
+		if account.IMAPHost == "" || account.IMAPUser == "" || account.IMAPPassword == "" {
+			return errors.New("imap_host, imap_user and imap_password are required to fetch over IMAP")
+		}
+		if account.IMAPPort == 0 {
+			account.IMAPPort = defaultIMAPPort
+		}
+	default:
+		return fmt.Errorf("invalid fetch method %q", account.FetchMethod)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// CheckpointStore persists mailbox sync progress so fetchers can resume
+// where they stopped after a restart
+type CheckpointStore struct {
+	db *gorm.DB
+}
+
+// NewCheckpointStore creates a new checkpoint store
+func NewCheckpointStore(db *gorm.DB) *CheckpointStore {
+	return &CheckpointStore{
+		db: db,
+	}
+}
+
+// Load returns the checkpoint for a mailbox of a mail account, or nil if none
+// has been saved yet. account is the address the mailbox is fetched as; a new
+// checkpoint is started when it changes.
+func (s *CheckpointStore) Load(accountID uint, account, mailbox string) (*model.MailboxCheckpoint, error) {
+	var checkpoint model.MailboxCheckpoint
+	result := s.db.Where("account_id = ? AND account = ? AND mailbox = ?", accountID, account, mailbox).First(&checkpoint)
+
+	if result.Error == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to load checkpoint for %s/%s: %w", account, mailbox, result.Error)
+	}
+
+	return &checkpoint, nil
+}
+
+// Save creates or updates a mailbox checkpoint
+func (s *CheckpointStore) Save(checkpoint *model.MailboxCheckpoint) error {
+	if err := s.db.Save(checkpoint).Error; err != nil {
+		return fmt.Errorf("failed to save checkpoint for %s/%s: %w", checkpoint.Account, checkpoint.Mailbox, err)
+	}
+	return nil
+}
+
+// commitCheckpoint saves the pending checkpoint of a fetcher, if any, and
+// clears it
+func commitCheckpoint(store *CheckpointStore, pending **model.MailboxCheckpoint) error {
+	if *pending == nil {
+		return nil
+	}
+	if err := store.Save(*pending); err != nil {
+		return err
+	}
+	*pending = nil
+	return nil
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// ErrInvalidCSV is returned by ImportContactsCSV when the input is not valid
+// CSV
+var ErrInvalidCSV = errors.New("invalid CSV")
+
+// ContactImportResult summarizes a contacts CSV import
+type ContactImportResult struct {
+	Created int                  `json:"created"`
+	Updated int                  `json:"updated"`
+	Errors  []ContactImportError `json:"errors,omitempty"`
+}
+
+// ContactImportError describes a CSV row that could not be imported. Row is
+// the 1-based record number, counting the header row.
+type ContactImportError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// ImportContactsCSV creates or updates contacts from CSV data. The name and
+// email columns are located by an optional header row and default to the
+// first two columns. Existing contacts are matched by name and get their
+// address updated. Invalid rows are reported in the result and skipped; the
+// valid rows are imported in a single transaction.
+func ImportContactsCSV(db *gorm.DB, r io.Reader) (*ContactImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSV, err)
+	}
+
+	nameCol, emailCol, start := 0, 1, 0
+	if len(records) > 0 {
+		if n, e, ok := contactHeader(records[0]); ok {
+			nameCol, emailCol, start = n, e, 1
+		}
+	}
+
+	result := &ContactImportResult{}
+	contacts := make(map[string]model.Contact)
+	var order []string
+
+	for i := start; i < len(records); i++ {
+		record := records[i]
+		row := i + 1
+
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if len(record) <= nameCol || len(record) <= emailCol {
+			result.Errors = append(result.Errors, ContactImportError{Row: row, Message: "missing name or email column"})
+			continue
+		}
+
+		contact, err := newContact(record[nameCol], record[emailCol])
+		if err != nil {
+			result.Errors = append(result.Errors, ContactImportError{Row: row, Message: err.Error()})
+			continue
+		}
+
+		// Later rows for the same name win
+		key := strings.ToLower(contact.Name)
+		if _, ok := contacts[key]; !ok {
+			order = append(order, key)
+		}
+		contacts[key] = contact
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, key := range order {
+			contact := contacts[key]
+
+			var existing model.Contact
+			err := tx.Where("name = ?", contact.Name).First(&existing).Error
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				if err := tx.Create(&contact).Error; err != nil {
+					return err
+				}
+				result.Created++
+			case err != nil:
+				return err
+			case existing.Email != contact.Email:
+				if err := tx.Model(&existing).Update("email", contact.Email).Error; err != nil {
+					return err
+				}
+				result.Updated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to import contacts: %w", err)
+	}
+
+	return result, nil
+}
+
+// ValidateContact normalizes and checks the name and address of a contact
+func ValidateContact(contact *model.Contact) error {
+	normalized, err := newContact(contact.Name, contact.Email)
+	if err != nil {
+		return err
+	}
+
+	contact.Name = normalized.Name
+	contact.Email = normalized.Email
+	return nil
+}
+
+// newContact builds a contact from raw name and address values
+func newContact(name, email string) (model.Contact, error) {
+	name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+	if name == "" {
+		return model.Contact{}, errors.New("contact name is required")
+	}
+
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return model.Contact{}, fmt.Errorf("invalid email address %q", email)
+	}
+
+	return model.Contact{Name: name, Email: address.Address}, nil
+}
+
+// contactHeader returns the name and email column indexes of a CSV header row
+func contactHeader(record []string) (nameCol, emailCol int, ok bool) {
+	nameCol, emailCol = -1, -1
+	for i, field := range record {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(field, "\ufeff"))) {
+		case "name":
+			nameCol = i
+		case "email":
+			emailCol = i
+		}
+	}
+	return nameCol, emailCol, nameCol >= 0 && emailCol >= 0
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// gmailSendAttempts is how many times messages.send is tried for one
+	// forward before the failure is returned to the caller
+	gmailSendAttempts = 3
+	// gmailBackoffBase is the backoff before the first retry; it doubles
+	// with every further attempt
+	gmailBackoffBase = time.Second
+	// gmailMaxRetryWait is the longest pause ForwardEmail blocks for. Longer
+	// Retry-After values are returned to the caller in a *RetryAfterError.
+	gmailMaxRetryWait = time.Minute
+)
+
+// gmailRateLimitReasons are the 403 error reasons Gmail uses for rate limits
+// rather than for a lack of permission
+var gmailRateLimitReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// ClassifyGmailError inspects an error returned by messages.send at now.
+// Failures caused by the message itself, such as an invalid recipient, are
+// wrapped in a *PermanentError, and failures the server sent a Retry-After
+// with in a *RetryAfterError. retry reports whether the send is worth
+// repeating right away: rate limits (429 or a rate limit 403), server errors
+// and network errors are.
+func ClassifyGmailError(err error, now time.Time) (classified error, retry bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err, false
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err, true
+	}
+
+	if retryAfter := ParseRetryAfter(apiErr.Header.Get("Retry-After"), now); retryAfter > 0 {
+		err = &RetryAfterError{Err: err, RetryAfter: retryAfter}
+	}
+
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests,
+		apiErr.Code == http.StatusRequestTimeout,
+		apiErr.Code >= http.StatusInternalServerError:
+		return err, true
+	case apiErr.Code == http.StatusForbidden:
+		for _, item := range apiErr.Errors {
+			if gmailRateLimitReasons[item.Reason] {
+				return err, true
+			}
+		}
+		// Missing scopes or an exhausted daily quota may be fixed without
+		// changing the message, so the forward stays retryable later
+		return err, false
+	case apiErr.Code == http.StatusUnauthorized:
+		return err, false
+	case apiErr.Code >= http.StatusBadRequest:
+		return &PermanentError{Err: err}, false
+	}
+
+	return err, false
+}
+
+// gmailRetryDelay returns how long to wait before repeating a send after the
+// given number of failed attempts: an exponential backoff with jitter, or the
+// server's Retry-After if that is longer. ok is false when the wait would
+// exceed gmailMaxRetryWait.
+func gmailRetryDelay(err error, attempt int) (wait time.Duration, ok bool) {
+	backoff := gmailBackoffBase << (attempt - 1)
+	wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	if retryAfter := RetryAfter(err); retryAfter > wait {
+		wait = retryAfter
+	}
+
+	return wait, wait <= gmailMaxRetryWait
+}
+
+// ParseRetryAfter parses a Retry-After header value received at now, given
+// either in seconds or as an HTTP date. It returns 0 if the value is empty,
+// invalid or in the past.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+const (
+	// gmailMailbox is the label fetched through the Gmail API
+	gmailMailbox = "INBOX"
+	// defaultMaxMessagesPerCycle is used when no per-cycle cap is configured
+	defaultMaxMessagesPerCycle = 500
+	// maxGmailPageSize is the largest page size accepted by the Gmail API
+	maxGmailPageSize = 500
+)
+
+// listHistory returns the ids of messages added since checkpoint.HistoryID.
+// Listing resumes from checkpoint.PageToken and stops after the configured
+// per-cycle cap; the remaining pages are left in the checkpoint for the next
+// cycle. Once the last page is read the checkpoint moves to the current
+// mailbox history id.
+func (f *GmailAPIFetcher) listHistory(ctx context.Context, checkpoint *model.MailboxCheckpoint) ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+
+	for {
+		call := f.service.Users.History.List(f.userEmail).
+			StartHistoryId(checkpoint.HistoryID).
+			HistoryTypes("messageAdded").
+			LabelId(gmailMailbox).
+			MaxResults(f.pageSize()).
+			Context(ctx)
+		if checkpoint.PageToken != "" {
+			call = call.PageToken(checkpoint.PageToken)
+		}
+
+		response, err := call.Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list history: %w", err)
+		}
+
+		for _, history := range response.History {
+			for _, added := range history.MessagesAdded {
+				if added.Message == nil || seen[added.Message.Id] {
+					continue
+				}
+				seen[added.Message.Id] = true
+				ids = append(ids, added.Message.Id)
+			}
+		}
+
+		if response.NextPageToken == "" {
+			if response.HistoryId > checkpoint.HistoryID {
+				checkpoint.HistoryID = response.HistoryId
+			}
+			checkpoint.PageToken = ""
+			return ids, nil
+		}
+
+		checkpoint.PageToken = response.NextPageToken
+		if len(ids) >= f.maxMessagesPerCycle {
+			logrus.Infof("Reached limit of %d messages, remaining history will be fetched next cycle", f.maxMessagesPerCycle)
+			return ids, nil
+		}
+	}
+}
+
+// startFullSync prepares the checkpoint for listing recent messages when no
+// usable history id is available. The mailbox history id is read first so
+// that nothing arriving during the sync is missed by the incremental runs
+// that follow it.
+func (f *GmailAPIFetcher) startFullSync(ctx context.Context, checkpoint *model.MailboxCheckpoint) error {
+	profile, err := f.service.Users.GetProfile(f.userEmail).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get profile: %w", err)
+	}
+
+	checkpoint.HistoryID = profile.HistoryId
+	checkpoint.SyncQuery = fmt.Sprintf("after:%d", time.Now().Add(-initialSyncWindow).Unix())
+	checkpoint.PageToken = ""
+	return nil
+}
+
+// listFullSync pages through the messages matched by checkpoint.SyncQuery,
+// resuming from checkpoint.PageToken and stopping after the per-cycle cap.
+// The full sync is finished once the last page has been read.
+func (f *GmailAPIFetcher) listFullSync(ctx context.Context, checkpoint *model.MailboxCheckpoint) ([]string, error) {
+	var ids []string
+
+	for {
+		call := f.service.Users.Messages.List(f.userEmail).
+			LabelIds(gmailMailbox).
+			Q(checkpoint.SyncQuery).
+			MaxResults(f.pageSize()).
+			Context(ctx)
+		if checkpoint.PageToken != "" {
+			call = call.PageToken(checkpoint.PageToken)
+		}
+
+		response, err := call.Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list messages: %w", err)
+		}
+
+		for _, msg := range response.Messages {
+			ids = append(ids, msg.Id)
+		}
+
+		if response.NextPageToken == "" {
+			checkpoint.SyncQuery = ""
+			checkpoint.PageToken = ""
+			return ids, nil
+		}
+
+		checkpoint.PageToken = response.NextPageToken
+		if len(ids) >= f.maxMessagesPerCycle {
+			logrus.Infof("Reached limit of %d messages, full sync will continue next cycle", f.maxMessagesPerCycle)
+			return ids, nil
+		}
+	}
+}
+
+// pageSize returns the page size used for list calls
+func (f *GmailAPIFetcher) pageSize() int64 {
+	if f.maxMessagesPerCycle < maxGmailPageSize {
+		return int64(f.maxMessagesPerCycle)
+	}
+	return maxGmailPageSize
+}
+
+// isHistoryExpired reports whether err means the start history id is too old
+// for users.history.list, which Gmail signals with 404 Not Found
+func isHistoryExpired(err error) bool {
+	return isNotFound(err)
+}
+
+// isNotFound reports whether err is a Gmail API 404 Not Found
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// idleRefreshInterval restarts IDLE before the server's inactivity
+	// timeout (RFC 2177 recommends re-issuing it at least every 29 minutes)
+	idleRefreshInterval = 20 * time.Minute
+	// idleReconnectMin and idleReconnectMax bound the reconnect backoff
+	idleReconnectMin = 5 * time.Second
+	idleReconnectMax = 5 * time.Minute
+)
+
+// Watch keeps a dedicated IDLE connection open on INBOX and calls notify when
+// the server reports a mailbox change. Dropped connections are re-established
+// with exponential backoff. ErrPushUnavailable is returned when IDLE is
+// disabled in the configuration or not supported by the server.
+func (f *IMAPFetcher) Watch(ctx context.Context, notify func()) error {
+	if !f.config.IMAPIdle {
+		return ErrPushUnavailable
+	}
+
+	backoff := idleReconnectMin
+	for {
+		established, err := f.idle(ctx, notify)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, ErrPushUnavailable) {
+			return err
+		}
+
+		if established {
+			backoff = idleReconnectMin
+		}
+
+		logrus.Warnf("IMAP IDLE connection lost, reconnecting in %v: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > idleReconnectMax {
+			backoff = idleReconnectMax
+		}
+	}
+}
+
+// idle opens a new connection and idles on INBOX until ctx is cancelled or the
+// connection fails. The returned bool reports whether IDLE was entered.
+func (f *IMAPFetcher) idle(ctx context.Context, notify func()) (bool, error) {
+	c, err := dialIMAP(f.config)
+	if err != nil {
+		return false, err
+	}
+	defer c.Logout()
+
+	supported, err := c.Support("IDLE")
+	if err != nil {
+		return false, fmt.Errorf("failed to query IMAP capabilities: %w", err)
+	}
+	if !supported {
+		logrus.Warn("IMAP server does not support IDLE")
+		return false, ErrPushUnavailable
+	}
+
+	if _, err := c.Select(imapMailbox, true); err != nil {
+		return false, fmt.Errorf("failed to select %s: %w", imapMailbox, err)
+	}
+
+	updates := make(chan client.Update, 16)
+	c.Updates = updates
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stop, &client.IdleOptions{
+			LogoutTimeout: idleRefreshInterval,
+			PollInterval:  -1,
+		})
+	}()
+
+	logrus.Info("IMAP IDLE connection established, waiting for new emails")
+
+	for {
+		select {
+		case update := <-updates:
+			// EXISTS responses arrive as mailbox updates
+			if _, ok := update.(*client.MailboxUpdate); ok {
+				notify()
+			}
+		case err := <-done:
+			if err == nil {
+				err = errors.New("IDLE command ended unexpectedly")
+			}
+			return true, err
+		case <-ctx.Done():
+			close(stop)
+			// Keep draining updates so the client can finish the IDLE command
+			for {
+				select {
+				case <-updates:
+				case <-done:
+					return true, nil
+				}
+			}
+		}
+	}
+}
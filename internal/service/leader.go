@@ -0,0 +1,120 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"smart-mail-relay-go/config"
+	"smart-mail-relay-go/internal/model"
+)
+
+const (
+	// schedulerLeaseName is the lease that elects the instance running the
+	// processing cycles
+	schedulerLeaseName = "scheduler"
+	// defaultLeaseTTL is how long a lease stays valid without renewal when
+	// no TTL is configured
+	defaultLeaseTTL = 30 * time.Second
+)
+
+// LeaderElector elects one service instance as the scheduler leader using a
+// lease row in the database. Expiry is evaluated with the database clock, so
+// the instances' clocks do not need to agree.
+type LeaderElector struct {
+	db  *gorm.DB
+	id  string
+	ttl time.Duration
+}
+
+// NewLeaderElector creates a new leader elector. The instance is identified
+// by cfg.InstanceID, or by its host name and process ID if that is empty.
+func NewLeaderElector(db *gorm.DB, cfg *config.SchedulerConfig) *LeaderElector {
+	id := cfg.InstanceID
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "unknown"
+		}
+		id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	ttl := cfg.LeaseTTL
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+
+	return &LeaderElector{
+		db:  db,
+		id:  id,
+		ttl: ttl,
+	}
+}
+
+// ID returns the identity of this instance
+func (e *LeaderElector) ID() string {
+	return e.id
+}
+
+// TTL returns how long an acquired lease stays valid
+func (e *LeaderElector) TTL() time.Duration {
+	return e.ttl
+}
+
+// TryAcquire takes or renews the lease. It reports whether this instance
+// holds the lease afterwards.
+func (e *LeaderElector) TryAcquire() (bool, error) {
+	expiresAt := gorm.Expr("DATE_ADD(NOW(3), INTERVAL ? MICROSECOND)", e.ttl.Microseconds())
+
+	result := e.db.Model(&model.SchedulerLease{}).
+		Where("name = ? AND (holder = ? OR expires_at <= NOW(3))", schedulerLeaseName, e.id).
+		Updates(map[string]interface{}{"holder": e.id, "expires_at": expiresAt})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to renew scheduler lease: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// The lease is held by another instance, or has never been created
+	result = e.db.Model(&model.SchedulerLease{}).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(map[string]interface{}{
+			"name":       schedulerLeaseName,
+			"holder":     e.id,
+			"expires_at": expiresAt,
+			"updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to create scheduler lease: %w", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// Release gives up the lease if this instance holds it, so another instance
+// can take over without waiting for it to expire
+func (e *LeaderElector) Release() error {
+	result := e.db.Model(&model.SchedulerLease{}).
+		Where("name = ? AND holder = ?", schedulerLeaseName, e.id).
+		Update("expires_at", gorm.Expr("NOW(3)"))
+	if result.Error != nil {
+		return fmt.Errorf("failed to release scheduler lease: %w", result.Error)
+	}
+	return nil
+}
+
+// Leader returns the current unexpired lease, or nil if no instance holds it
+func (e *LeaderElector) Leader() (*model.SchedulerLease, error) {
+	var lease model.SchedulerLease
+	result := e.db.Where("name = ? AND expires_at > NOW(3)", schedulerLeaseName).First(&lease)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get scheduler lease: %w", result.Error)
+	}
+	return &lease, nil
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
@@ -16,7 +17,6 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-message"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 
@@ -24,41 +24,160 @@ import (
 	"smart-mail-relay-go/internal/model"
 )
 
-// EmailMessage represents an email message structure
+// EmailMessage represents an email message structure. AccountID is the mail
+// account it was fetched from, 0 for the mailbox configured in the config
+// file.
 type EmailMessage struct {
-	ID       string            `json:"id"`
-	Subject  string            `json:"subject"`
-	From     string            `json:"from"`
-	To       []string          `json:"to"`
-	CC       []string          `json:"cc"`
-	BCC      []string          `json:"bcc"`
-	Body     string            `json:"body"`
-	HTMLBody string            `json:"html_body"`
-	Headers  map[string]string `json:"headers"`
-	Raw      []byte            `json:"raw"`
-}
-
-// EmailFetcher interface for fetching emails
+	ID        string            `json:"id"`
+	AccountID uint              `json:"account_id"`
+	Subject   string            `json:"subject"`
+	From      string            `json:"from"`
+	To        []string          `json:"to"`
+	CC        []string          `json:"cc"`
+	BCC       []string          `json:"bcc"`
+	Body      string            `json:"body"`
+	HTMLBody  string            `json:"html_body"`
+	Headers   map[string]string `json:"headers"`
+	Raw       []byte            `json:"raw"`
+
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment represents a non-body MIME part of an email, such as a file
+// attachment or an inline image
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id"`
+	Inline      bool   `json:"inline"`
+	Data        []byte `json:"data"`
+}
+
+// EmailFetcher interface for fetching emails. FetchNewEmails returns the
+// emails after the stored mailbox checkpoint without moving it; Commit saves
+// the checkpoint past the emails of the last FetchNewEmails once the caller
+// has recorded every one of them. Emails that were fetched but never
+// committed are fetched again by the next FetchNewEmails, including after a
+// restart.
 type EmailFetcher interface {
 	FetchNewEmails(ctx context.Context) ([]EmailMessage, error)
+	Commit() error
+	Close() error
+}
+
+// EmailForwarder interface for forwarding emails. ForwardEmail sends a single
+// message to all recipients and returns a *RecipientError when only some of
+// them were rejected, or a *PermanentError when sending it again cannot
+// succeed.
+type EmailForwarder interface {
+	ForwardEmail(ctx context.Context, originalEmail EmailMessage, recipients Recipients, opts ForwardOptions) error
 	Close() error
 }
 
+// ForwardOptions controls how an email is forwarded
+type ForwardOptions struct {
+	// Mode is one of the model.DeliveryMode* values; empty means inline
+	Mode string
+	// Templates customizes the subject, header block and footer of inline
+	// and attachment forwards
+	Templates ForwardTemplates
+	// Subject and Rule are made available to the templates
+	Subject SubjectParts
+	Rule    *model.ForwardRule
+}
+
+// PermanentError wraps a forwarding failure that will not succeed when
+// retried, such as an invalid recipient or a malformed message
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// IsPermanent reports whether err, or an error it wraps, is a *PermanentError
+func IsPermanent(err error) bool {
+	var permanentErr *PermanentError
+	return errors.As(err, &permanentErr)
+}
+
+// RetryAfterError wraps a forwarding failure after which the server asked
+// not to be retried before RetryAfter has passed
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfter returns how long the server asked to wait before retrying after
+// err, or 0 if it did not
+func RetryAfter(err error) time.Duration {
+	var retryAfterErr *RetryAfterError
+	if errors.As(err, &retryAfterErr) {
+		return retryAfterErr.RetryAfter
+	}
+	return 0
+}
+
+// ErrPushUnavailable is returned by EmailWatcher.Watch when push notifications
+// cannot be used and the caller has to rely on polling
+var ErrPushUnavailable = errors.New("push notifications unavailable")
+
+// EmailWatcher is implemented by fetchers that can report new emails as soon
+// as they arrive. Watch blocks until ctx is cancelled and calls notify for
+// every new-mail notification received from the server.
+type EmailWatcher interface {
+	Watch(ctx context.Context, notify func()) error
+}
+
 // GmailAPIFetcher implements EmailFetcher using Gmail API
 type GmailAPIFetcher struct {
-	service   *gmail.Service
-	userEmail string
-	lastCheck time.Time
+	service             *gmail.Service
+	accountID           uint
+	userEmail           string
+	checkpoints         *CheckpointStore
+	maxMessagesPerCycle int
+	// pending is the checkpoint past the last fetched emails, saved by Commit
+	pending *model.MailboxCheckpoint
 }
 
 // IMAPFetcher implements EmailFetcher using IMAP
 type IMAPFetcher struct {
-	client    *client.Client
-	lastCheck time.Time
+	client      *client.Client
+	accountID   uint
+	config      *config.GmailConfig
+	checkpoints *CheckpointStore
+	// pending is the checkpoint past the last fetched emails, saved by Commit
+	pending *model.MailboxCheckpoint
 }
 
-// NewGmailAPIFetcher creates a new Gmail API fetcher
-func NewGmailAPIFetcher(cfg *config.GmailConfig) (*GmailAPIFetcher, error) {
+// errBodyUnavailable is returned when the body of a fetched IMAP message
+// could not be read, as opposed to a body that is malformed
+var errBodyUnavailable = errors.New("message body unavailable")
+
+const (
+	// imapMailbox is the mailbox fetched over IMAP
+	imapMailbox = "INBOX"
+	// initialSyncWindow is how far back a fetcher looks when it has no
+	// stored progress for a mailbox
+	initialSyncWindow = 24 * time.Hour
+)
+
+// NewGmailAPIFetcher creates a new Gmail API fetcher for a mail account. Its
+// sync progress is stored under the account ID.
+func NewGmailAPIFetcher(accountID uint, cfg *config.GmailConfig, checkpoints *CheckpointStore) (*GmailAPIFetcher, error) {
 	ctx := context.Background()
 
 	// Create OAuth2 config
@@ -82,15 +201,38 @@ func NewGmailAPIFetcher(cfg *config.GmailConfig) (*GmailAPIFetcher, error) {
 		return nil, fmt.Errorf("failed to create Gmail service: %w", err)
 	}
 
+	maxMessages := cfg.MaxMessagesPerCycle
+	if maxMessages <= 0 {
+		maxMessages = defaultMaxMessagesPerCycle
+	}
+
 	return &GmailAPIFetcher{
-		service:   service,
-		userEmail: cfg.UserEmail,
-		lastCheck: time.Now().Add(-24 * time.Hour), // Start with emails from last 24 hours
+		service:             service,
+		accountID:           accountID,
+		userEmail:           cfg.UserEmail,
+		checkpoints:         checkpoints,
+		maxMessagesPerCycle: maxMessages,
+	}, nil
+}
+
+// NewIMAPFetcher creates a new IMAP fetcher for a mail account. Its sync
+// progress is stored under the account ID.
+func NewIMAPFetcher(accountID uint, cfg *config.GmailConfig, checkpoints *CheckpointStore) (*IMAPFetcher, error) {
+	c, err := dialIMAP(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IMAPFetcher{
+		client:      c,
+		accountID:   accountID,
+		config:      cfg,
+		checkpoints: checkpoints,
 	}, nil
 }
 
-// NewIMAPFetcher creates a new IMAP fetcher
-func NewIMAPFetcher(cfg *config.GmailConfig) (*IMAPFetcher, error) {
+// dialIMAP connects and logs in to the configured IMAP server
+func dialIMAP(cfg *config.GmailConfig) (*client.Client, error) {
 	// Connect to IMAP server
 	c, err := client.DialTLS(fmt.Sprintf("%s:%d", cfg.IMAPHost, cfg.IMAPPort), nil)
 	if err != nil {
@@ -103,105 +245,114 @@ func NewIMAPFetcher(cfg *config.GmailConfig) (*IMAPFetcher, error) {
 		return nil, fmt.Errorf("failed to login to IMAP server: %w", err)
 	}
 
-	return &IMAPFetcher{
-		client:    c,
-		lastCheck: time.Now().Add(-24 * time.Hour), // Start with emails from last 24 hours
-	}, nil
+	return c, nil
 }
 
-// FetchNewEmails fetches new emails using Gmail API
+// FetchNewEmails fetches new emails using Gmail API. Messages added since the
+// stored history id are listed with users.history.list; without a usable
+// history id the fetcher falls back to a bounded full sync. Both listings are
+// capped per cycle and resume from the stored page token.
+//
+// The checkpoint only moves past the listed messages once all of them were
+// fetched: if getting one fails, the error is returned and the next cycle
+// lists them again. Messages deleted since they were listed and messages that
+// cannot be parsed are skipped.
 func (f *GmailAPIFetcher) FetchNewEmails(ctx context.Context) ([]EmailMessage, error) {
-	query := fmt.Sprintf("after:%d", f.lastCheck.Unix())
+	f.pending = nil
 
-	// Search for new messages
-	call := f.service.Users.Messages.List(f.userEmail).Q(query)
-	response, err := call.Do()
+	checkpoint, err := f.checkpoints.Load(f.accountID, f.userEmail, gmailMailbox)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list messages: %w", err)
+		return nil, err
+	}
+
+	if checkpoint == nil {
+		checkpoint = &model.MailboxCheckpoint{
+			AccountID: f.accountID,
+			Account:   f.userEmail,
+			Mailbox:   gmailMailbox,
+		}
+	}
+
+	if checkpoint.HistoryID == 0 {
+		logrus.Infof("No history checkpoint for %s, running full sync", f.userEmail)
+		if err := f.startFullSync(ctx, checkpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []string
+
+	if checkpoint.SyncQuery != "" {
+		ids, err = f.listFullSync(ctx, checkpoint)
+	} else {
+		ids, err = f.listHistory(ctx, checkpoint)
+		if isHistoryExpired(err) {
+			logrus.Warnf("History id %d for %s has expired, running full sync", checkpoint.HistoryID, f.userEmail)
+			if err := f.startFullSync(ctx, checkpoint); err != nil {
+				return nil, err
+			}
+			ids, err = f.listFullSync(ctx, checkpoint)
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	var emails []EmailMessage
 
-	for _, msg := range response.Messages {
-		// Get full message details
-		message, err := f.service.Users.Messages.Get(f.userEmail, msg.Id).Format("full").Do()
-		if err != nil {
-			logrus.Warnf("Failed to get message %s: %v", msg.Id, err)
+	for _, id := range ids {
+		// Get the raw message so the full MIME structure is available
+		message, err := f.service.Users.Messages.Get(f.userEmail, id).Format("raw").Context(ctx).Do()
+		if isNotFound(err) {
+			logrus.Warnf("Message %s was deleted before it could be fetched, skipping", id)
 			continue
 		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get message %s: %w", id, err)
+		}
 
 		email, err := f.parseGmailMessage(message)
 		if err != nil {
-			logrus.Warnf("Failed to parse message %s: %v", msg.Id, err)
+			logrus.Errorf("Failed to parse message %s, skipping: %v", id, err)
 			continue
 		}
 
 		emails = append(emails, email)
 	}
 
-	f.lastCheck = time.Now()
+	f.pending = checkpoint
 	return emails, nil
 }
 
-// parseGmailMessage parses a Gmail API message into EmailMessage
+// Commit saves the checkpoint past the emails of the last FetchNewEmails
+func (f *GmailAPIFetcher) Commit() error {
+	return commitCheckpoint(f.checkpoints, &f.pending)
+}
+
+// parseGmailMessage parses a raw Gmail API message into EmailMessage
 func (f *GmailAPIFetcher) parseGmailMessage(msg *gmail.Message) (EmailMessage, error) {
 	email := EmailMessage{
 		ID:      msg.Id,
 		Headers: make(map[string]string),
 	}
 
-	// Parse headers
-	for _, header := range msg.Payload.Headers {
-		email.Headers[header.Name] = header.Value
-
-		switch header.Name {
-		case "Subject":
-			email.Subject = header.Value
-		case "From":
-			email.From = header.Value
-		case "To":
-			email.To = strings.Split(header.Value, ",")
-		case "Cc":
-			email.CC = strings.Split(header.Value, ",")
-		}
+	// Gmail may omit the base64url padding
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(msg.Raw, "="))
+	if err != nil {
+		return email, fmt.Errorf("failed to decode raw message: %w", err)
 	}
 
-	// Parse body
-	if err := f.parseGmailBody(msg.Payload, &email); err != nil {
+	header, err := parseMIMEMessage(raw, &email)
+	if err != nil {
 		return email, err
 	}
 
-	return email, nil
-}
-
-// parseGmailBody recursively parses Gmail message body parts
-func (f *GmailAPIFetcher) parseGmailBody(part *gmail.MessagePart, email *EmailMessage) error {
-	if part.Body != nil && part.Body.Data != "" {
-		data, err := base64.URLEncoding.DecodeString(part.Body.Data)
-		if err != nil {
-			return fmt.Errorf("failed to decode body data: %w", err)
-		}
-
-		content := string(data)
-
-		switch part.MimeType {
-		case "text/plain":
-			email.Body = content
-		case "text/html":
-			email.HTMLBody = content
-		}
-	}
-
-	// Handle multipart messages
-	if part.Parts != nil {
-		for _, subPart := range part.Parts {
-			if err := f.parseGmailBody(subPart, email); err != nil {
-				return err
-			}
-		}
-	}
+	email.Subject = email.Headers["Subject"]
+	email.From = email.Headers["From"]
+	email.To = addressList(header, "To")
+	email.CC = addressList(header, "Cc")
 
-	return nil
+	return email, nil
 }
 
 // Close closes the Gmail API fetcher
@@ -210,58 +361,130 @@ func (f *GmailAPIFetcher) Close() error {
 	return nil
 }
 
-// FetchNewEmails fetches new emails using IMAP
+// FetchNewEmails fetches new emails using IMAP. Progress is tracked by the
+// mailbox UIDVALIDITY and the highest UID seen, both persisted in the database
+// by Commit. The checkpoint stays before a message whose body could not be
+// read, so it is fetched again; messages with a malformed body are skipped.
 func (f *IMAPFetcher) FetchNewEmails(ctx context.Context) ([]EmailMessage, error) {
+	f.pending = nil
+
 	// Select INBOX
-	_, err := f.client.Select("INBOX", false)
+	status, err := f.client.Select(imapMailbox, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select %s: %w", imapMailbox, err)
+	}
+
+	checkpoint, err := f.checkpoints.Load(f.accountID, f.config.IMAPUser, imapMailbox)
 	if err != nil {
-		return nil, fmt.Errorf("failed to select INBOX: %w", err)
+		return nil, err
 	}
 
-	// Search for messages since last check
 	criteria := imap.NewSearchCriteria()
-	criteria.Since = f.lastCheck
+	resync := checkpoint == nil || checkpoint.UIDValidity != status.UidValidity
+
+	switch {
+	case checkpoint == nil:
+		logrus.Infof("No checkpoint for %s, fetching emails from the last %v", imapMailbox, initialSyncWindow)
+		checkpoint = &model.MailboxCheckpoint{
+			AccountID: f.accountID,
+			Account:   f.config.IMAPUser,
+			Mailbox:   imapMailbox,
+		}
+		criteria.Since = time.Now().Add(-initialSyncWindow)
+	case resync:
+		logrus.Warnf("UIDVALIDITY of %s changed from %d to %d, resyncing emails from the last %v",
+			imapMailbox, checkpoint.UIDValidity, status.UidValidity, initialSyncWindow)
+		criteria.Since = time.Now().Add(-initialSyncWindow)
+	default:
+		// Search for messages after the last seen UID
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(checkpoint.LastUID+1, 0)
+	}
+
+	lastUID := checkpoint.LastUID
+	if resync {
+		// Everything already in the mailbox outside the search window is
+		// treated as seen
+		lastUID = 0
+		if status.UidNext > 0 {
+			lastUID = status.UidNext - 1
+		}
+	}
 
-	uids, err := f.client.Search(criteria)
+	uids, err := f.client.UidSearch(criteria)
 	if err != nil {
 		return nil, fmt.Errorf("failed to search messages: %w", err)
 	}
 
-	if len(uids) == 0 {
-		f.lastCheck = time.Now()
-		return []EmailMessage{}, nil
+	// A "n:*" range always matches the highest UID, even if it was already seen
+	var newUIDs []uint32
+	for _, uid := range uids {
+		if resync || uid > checkpoint.LastUID {
+			newUIDs = append(newUIDs, uid)
+		}
 	}
 
-	// Fetch messages
-	seqset := new(imap.SeqSet)
-	seqset.AddNum(uids...)
-
-	messages := make(chan *imap.Message, len(uids))
-	done := make(chan error, 1)
+	var emails []EmailMessage
 
-	go func() {
-		done <- f.client.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchBody, imap.FetchUid}, messages)
-	}()
+	if len(newUIDs) > 0 {
+		// Fetch messages
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(newUIDs...)
+
+		section := &imap.BodySectionName{Peek: true}
+		items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, section.FetchItem()}
+
+		messages := make(chan *imap.Message, len(newUIDs))
+		done := make(chan error, 1)
+
+		go func() {
+			done <- f.client.UidFetch(seqset, items, messages)
+		}()
+
+		var unread uint32
+		for msg := range messages {
+			email, err := f.parseIMAPMessage(msg)
+			if errors.Is(err, errBodyUnavailable) {
+				logrus.Warnf("Failed to read IMAP message %d, fetching it again next cycle: %v", msg.Uid, err)
+				if unread == 0 || msg.Uid < unread {
+					unread = msg.Uid
+				}
+				continue
+			}
 
-	var emails []EmailMessage
+			if msg.Uid > lastUID {
+				lastUID = msg.Uid
+			}
+			if err != nil {
+				logrus.Errorf("Failed to parse IMAP message %d, skipping: %v", msg.Uid, err)
+				continue
+			}
+			if email.ID == "" {
+				email.ID = fmt.Sprintf("imap-%d-%d", status.UidValidity, msg.Uid)
+			}
+			emails = append(emails, email)
+		}
 
-	for msg := range messages {
-		email, err := f.parseIMAPMessage(msg)
-		if err != nil {
-			logrus.Warnf("Failed to parse IMAP message: %v", err)
-			continue
+		if err := <-done; err != nil {
+			return nil, fmt.Errorf("failed to fetch messages: %w", err)
 		}
-		emails = append(emails, email)
-	}
 
-	if err := <-done; err != nil {
-		return nil, fmt.Errorf("failed to fetch messages: %w", err)
+		if unread > 0 && lastUID >= unread {
+			lastUID = unread - 1
+		}
 	}
 
-	f.lastCheck = time.Now()
+	checkpoint.UIDValidity = status.UidValidity
+	checkpoint.LastUID = lastUID
+	f.pending = checkpoint
 	return emails, nil
 }
 
+// Commit saves the checkpoint past the emails of the last FetchNewEmails
+func (f *IMAPFetcher) Commit() error {
+	return commitCheckpoint(f.checkpoints, &f.pending)
+}
+
 // parseIMAPMessage parses an IMAP message into EmailMessage
 func (f *IMAPFetcher) parseIMAPMessage(msg *imap.Message) (EmailMessage, error) {
 	email := EmailMessage{
@@ -269,6 +492,7 @@ func (f *IMAPFetcher) parseIMAPMessage(msg *imap.Message) (EmailMessage, error)
 	}
 
 	if msg.Envelope != nil {
+		email.ID = msg.Envelope.MessageId
 		email.Subject = msg.Envelope.Subject
 		if msg.Envelope.From != nil && len(msg.Envelope.From) > 0 {
 			email.From = msg.Envelope.From[0].Address()
@@ -278,6 +502,9 @@ func (f *IMAPFetcher) parseIMAPMessage(msg *imap.Message) (EmailMessage, error)
 				email.To = append(email.To, addr.Address())
 			}
 		}
+		for _, addr := range msg.Envelope.Cc {
+			email.CC = append(email.CC, addr.Address())
+		}
 	}
 
 	// Parse body
@@ -290,57 +517,19 @@ func (f *IMAPFetcher) parseIMAPMessage(msg *imap.Message) (EmailMessage, error)
 
 // parseIMAPBody parses IMAP message body
 func (f *IMAPFetcher) parseIMAPBody(msg *imap.Message, email *EmailMessage) error {
-	if msg.Body == nil {
-		return nil
-	}
-
 	section := &imap.BodySectionName{}
 	r := msg.GetBody(section)
 	if r == nil {
-		return fmt.Errorf("failed to get message body")
+		return fmt.Errorf("%w: no body in the fetch response", errBodyUnavailable)
 	}
 
-	entity, err := message.Read(r)
+	raw, err := io.ReadAll(r)
 	if err != nil {
-		return fmt.Errorf("failed to read message: %w", err)
+		return fmt.Errorf("%w: %v", errBodyUnavailable, err)
 	}
 
-	// Parse multipart message
-	if mr := entity.MultipartReader(); mr != nil {
-		for {
-			p, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("failed to read part: %w", err)
-			}
-
-			content, err := io.ReadAll(p.Body)
-			if err != nil {
-				return fmt.Errorf("failed to read part body: %w", err)
-			}
-
-			contentType := p.Header.Get("Content-Type")
-			if strings.Contains(contentType, "text/plain") {
-				email.Body = string(content)
-			} else if strings.Contains(contentType, "text/html") {
-				email.HTMLBody = string(content)
-			}
-		}
-	} else {
-		// Single part message
-		content, err := io.ReadAll(entity.Body)
-		if err != nil {
-			return fmt.Errorf("failed to read message body: %w", err)
-		}
-
-		contentType := entity.Header.Get("Content-Type")
-		if strings.Contains(contentType, "text/plain") {
-			email.Body = string(content)
-		} else if strings.Contains(contentType, "text/html") {
-			email.HTMLBody = string(content)
-		}
+	if _, err := parseMIMEMessage(raw, email); err != nil {
+		return err
 	}
 
 	return nil
@@ -353,115 +542,108 @@ func (f *IMAPFetcher) Close() error {
 
 // EmailParser handles parsing and matching of email subjects
 type EmailParser struct {
-	db *gorm.DB
-}
-
-// NewEmailParser creates a new email parser
-func NewEmailParser(db *gorm.DB) *EmailParser {
-	return &EmailParser{
-		db: db,
-	}
+	db      *gorm.DB
+	grammar *subjectGrammar
 }
 
-// ParseAndMatchEmail parses an email and finds matching forwarding rules
-func (p *EmailParser) ParseAndMatchEmail(email EmailMessage) (*model.ForwardRule, error) {
-	// Extract keyword from subject
-	keyword, err := p.ExtractKeyword(email.Subject)
+// NewEmailParser creates a new email parser. A nil cfg uses the default
+// subject grammar.
+func NewEmailParser(db *gorm.DB, cfg *config.ParserConfig) (*EmailParser, error) {
+	grammar, err := newSubjectGrammar(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract keyword from subject: %w", err)
+		return nil, err
 	}
 
-	if keyword == "" {
+	return &EmailParser{
+		db:      db,
+		grammar: grammar,
+	}, nil
+}
+
+// ParseAndMatchRules parses an email and returns the forwarding rules to
+// apply with their recipients, in the order they should be applied
+func (p *EmailParser) ParseAndMatchRules(email EmailMessage) ([]RuleMatch, error) {
+	// Extract keyword and recipient name from subject
+	parts := p.ParseSubject(email.Subject)
+	if parts.Keyword == "" {
 		logrus.Debugf("No keyword found in subject: %s", email.Subject)
-		return nil, nil
 	}
 
-	// Find matching rule
-	rule, err := p.findMatchingRule(keyword)
+	// Find matching rules
+	matches, err := p.findMatchingRules(email, parts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find matching rule: %w", err)
+		return nil, fmt.Errorf("failed to find matching rules: %w", err)
 	}
 
-	if rule == nil {
-		logrus.Debugf("No matching rule found for keyword: %s", keyword)
+	if len(matches) == 0 {
+		logrus.Debugf("No matching rule found for keyword: %s", parts.Keyword)
 		return nil, nil
 	}
 
-	logrus.Infof("Found matching rule for keyword '%s': %s -> %s", keyword, rule.Keyword, rule.TargetEmail)
-	return rule, nil
+	for i := range matches {
+		matches[i].Subject = parts
+		logrus.Infof("Found matching rule %d for keyword '%s': %s -> %s", matches[i].Rule.ID, parts.Keyword, matches[i].Rule.Keyword, matches[i].Recipients)
+	}
+	return matches, nil
 }
 
-// ExtractKeyword extracts the keyword from email subject
-// Expected format: "<keyword> - <recipient_name>"
+// ExtractKeyword extracts the keyword from email subject, see ParseSubject
 func (p *EmailParser) ExtractKeyword(subject string) (string, error) {
-	if subject == "" {
-		return "", nil
-	}
-
-	// Clean up the subject
-	subject = strings.TrimSpace(subject)
-
-	// Try to match the pattern "<keyword> - <recipient_name>"
-	// This regex matches: word/words followed by " - " followed by any text
-	pattern := `^([^-]+)\s*-\s*(.+)$`
-	re := regexp.MustCompile(pattern)
-
-	matches := re.FindStringSubmatch(subject)
-	if len(matches) < 3 {
-		// If the pattern doesn't match, try to extract just the first word as keyword
-		words := strings.Fields(subject)
-		if len(words) > 0 {
-			return strings.TrimSpace(words[0]), nil
-		}
-		return "", nil
-	}
-
-	keyword := strings.TrimSpace(matches[1])
-	return keyword, nil
+	return p.ParseSubject(subject).Keyword, nil
 }
 
-// findMatchingRule finds a forwarding rule that matches the given keyword
-func (p *EmailParser) findMatchingRule(keyword string) (*model.ForwardRule, error) {
-	var rule model.ForwardRule
-
-	// First try exact match
-	result := p.db.Where("keyword = ? AND enabled = ?", keyword, true).First(&rule)
-	if result.Error == nil {
-		return &rule, nil
-	}
-
-	if result.Error != gorm.ErrRecordNotFound {
-		return nil, fmt.Errorf("database error: %w", result.Error)
-	}
+// ParseSubject extracts the keyword and recipient name from an email subject.
+// Reply/forward prefixes are stripped first, then the configured subject
+// patterns are tried in order (by default "[<keyword>] <recipient_name>" and
+// "<keyword> - <recipient_name>"). If none matches, the first word is used
+// as the keyword.
+func (p *EmailParser) ParseSubject(subject string) SubjectParts {
+	return p.grammar.parse(subject)
+}
 
-	// If no exact match, try case-insensitive match
-	result = p.db.Where("LOWER(keyword) = LOWER(?) AND enabled = ?", keyword, true).First(&rule)
-	if result.Error == nil {
-		return &rule, nil
+// findMatchingRules finds the forwarding rules that match the given email and
+// keyword. All enabled rules are evaluated, see SelectRules for the ordering
+// and the continue/stop handling.
+func (p *EmailParser) findMatchingRules(email EmailMessage, parts SubjectParts) ([]RuleMatch, error) {
+	rules, err := p.GetEnabledRules()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
 	}
 
-	if result.Error != gorm.ErrRecordNotFound {
-		return nil, fmt.Errorf("database error: %w", result.Error)
+	// The address book is only consulted when a rule routes by recipient name
+	var contact *model.Contact
+	for _, rule := range rules {
+		if rule.ResolveRecipient && parts.Recipient != "" {
+			contact, err = p.FindContact(parts.Recipient)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
 	}
 
-	// If still no match, try partial match (keyword contains the search term)
-	result = p.db.Where("keyword LIKE ? AND enabled = ?", "%"+keyword+"%", true).First(&rule)
-	if result.Error == nil {
-		return &rule, nil
-	}
+	return SelectRules(rules, email, parts.Keyword, contact), nil
+}
 
-	if result.Error != gorm.ErrRecordNotFound {
-		return nil, fmt.Errorf("database error: %w", result.Error)
+// FindContact returns the contact with the given name, or nil if there is
+// none. Names are compared using the database collation, which ignores case
+// by default.
+func (p *EmailParser) FindContact(name string) (*model.Contact, error) {
+	var contact model.Contact
+	result := p.db.Where("name = ?", strings.TrimSpace(name)).First(&contact)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find contact: %w", result.Error)
 	}
-
-	// No matching rule found
-	return nil, nil
+	return &contact, nil
 }
 
 // GetAllRules returns all forwarding rules
 func (p *EmailParser) GetAllRules() ([]model.ForwardRule, error) {
 	var rules []model.ForwardRule
-	result := p.db.Find(&rules)
+	result := p.db.Preload("Conditions").Preload("Targets").Preload("Accounts").Order("priority, id").Find(&rules)
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to get rules: %w", result.Error)
 	}
@@ -471,17 +653,18 @@ func (p *EmailParser) GetAllRules() ([]model.ForwardRule, error) {
 // GetEnabledRules returns all enabled forwarding rules
 func (p *EmailParser) GetEnabledRules() ([]model.ForwardRule, error) {
 	var rules []model.ForwardRule
-	result := p.db.Where("enabled = ?", true).Find(&rules)
+	result := p.db.Preload("Conditions").Preload("Targets").Preload("Accounts").Where("enabled = ?", true).Order("priority, id").Find(&rules)
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to get enabled rules: %w", result.Error)
 	}
 	return rules, nil
 }
 
-// IsEmailProcessed checks if an email has already been processed
-func (p *EmailParser) IsEmailProcessed(messageID string) (bool, error) {
+// IsEmailProcessed checks if an email of a mail account has already been
+// processed
+func (p *EmailParser) IsEmailProcessed(accountID uint, messageID string) (bool, error) {
 	var processed model.ProcessedEmail
-	result := p.db.Where("message_id = ?", messageID).First(&processed)
+	result := p.db.Where("account_id = ? AND message_id = ?", accountID, messageID).First(&processed)
 
 	if result.Error == nil {
 		return true, nil // Email has been processed
@@ -494,9 +677,10 @@ func (p *EmailParser) IsEmailProcessed(messageID string) (bool, error) {
 	return false, fmt.Errorf("database error checking processed email: %w", result.Error)
 }
 
-// MarkEmailAsProcessed marks an email as processed
-func (p *EmailParser) MarkEmailAsProcessed(messageID string) error {
+// MarkEmailAsProcessed marks an email of a mail account as processed
+func (p *EmailParser) MarkEmailAsProcessed(accountID uint, messageID string) error {
 	processed := model.ProcessedEmail{
+		AccountID:   accountID,
 		MessageID:   messageID,
 		ProcessedAt: time.Now(),
 	}
@@ -509,17 +693,43 @@ func (p *EmailParser) MarkEmailAsProcessed(messageID string) error {
 	return nil
 }
 
-// LogForwardAttempt logs a forwarding attempt
-func (p *EmailParser) LogForwardAttempt(messageID string, ruleID *uint, status string, errorMsg string) error {
-	log := model.ForwardLog{
-		MessageID: messageID,
-		RuleID:    ruleID,
-		Status:    status,
-		ErrorMsg:  errorMsg,
-		CreatedAt: time.Now(),
+// GetForwardedRuleIDs returns the IDs of the rules an email of a mail account
+// has already been forwarded by, including deliveries where only some
+// recipients were rejected
+func (p *EmailParser) GetForwardedRuleIDs(accountID uint, messageID string) (map[uint]bool, error) {
+	var ruleIDs []uint
+	result := p.db.Model(&model.ForwardLog{}).
+		Where("account_id = ? AND message_id = ? AND status IN ? AND rule_id IS NOT NULL", accountID, messageID, []string{"success", "partial"}).
+		Pluck("rule_id", &ruleIDs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get forwarded rules: %w", result.Error)
+	}
+
+	forwarded := make(map[uint]bool, len(ruleIDs))
+	for _, id := range ruleIDs {
+		forwarded[id] = true
 	}
+	return forwarded, nil
+}
 
-	result := p.db.Create(&log)
+// NewForwardLog returns the log entry of a forwarding attempt together with
+// the status of each recipient
+func NewForwardLog(accountID uint, messageID string, ruleID *uint, status string, errorMsg string, recipients ...model.ForwardLogRecipient) *model.ForwardLog {
+	return &model.ForwardLog{
+		AccountID:  accountID,
+		MessageID:  messageID,
+		RuleID:     ruleID,
+		Status:     status,
+		ErrorMsg:   errorMsg,
+		CreatedAt:  time.Now(),
+		Recipients: recipients,
+	}
+}
+
+// LogForwardAttempt logs a forwarding attempt together with the status of
+// each recipient
+func (p *EmailParser) LogForwardAttempt(accountID uint, messageID string, ruleID *uint, status string, errorMsg string, recipients ...model.ForwardLogRecipient) error {
+	result := p.db.Create(NewForwardLog(accountID, messageID, ruleID, status, errorMsg, recipients...))
 	if result.Error != nil {
 		return fmt.Errorf("failed to log forward attempt: %w", result.Error)
 	}
@@ -527,15 +737,15 @@ func (p *EmailParser) LogForwardAttempt(messageID string, ruleID *uint, status s
 	return nil
 }
 
-// EmailForwarder handles forwarding emails via Gmail API
-type EmailForwarder struct {
+// GmailAPIForwarder implements EmailForwarder using Gmail API
+type GmailAPIForwarder struct {
 	service   *gmail.Service
 	userEmail string
 	config    *config.GmailConfig
 }
 
-// NewEmailForwarder creates a new email forwarder
-func NewEmailForwarder(cfg *config.GmailConfig) (*EmailForwarder, error) {
+// NewGmailAPIForwarder creates a new Gmail API forwarder
+func NewGmailAPIForwarder(cfg *config.GmailConfig) (*GmailAPIForwarder, error) {
 	ctx := context.Background()
 
 	// Create OAuth2 config
@@ -559,7 +769,7 @@ func NewEmailForwarder(cfg *config.GmailConfig) (*EmailForwarder, error) {
 		return nil, fmt.Errorf("failed to create Gmail service: %w", err)
 	}
 
-	return &EmailForwarder{
+	return &GmailAPIForwarder{
 		service:   service,
 		userEmail: cfg.UserEmail,
 		config:    cfg,
@@ -567,11 +777,22 @@ func NewEmailForwarder(cfg *config.GmailConfig) (*EmailForwarder, error) {
 }
 
 // ForwardEmail forwards an email to the target address
-func (f *EmailForwarder) ForwardEmail(ctx context.Context, originalEmail EmailMessage, targetEmail string) error {
-	// Create the forwarded email
-	forwardedEmail, err := f.createForwardedEmail(originalEmail, targetEmail)
+func (f *GmailAPIForwarder) ForwardEmail(ctx context.Context, originalEmail EmailMessage, recipients Recipients, opts ForwardOptions) error {
+	// Gmail derives the recipients from the To/Cc/Bcc headers and rewrites
+	// From, so a redirect would go back to the original recipients
+	if opts.Mode == model.DeliveryModeRedirect {
+		return &PermanentError{Err: fmt.Errorf("redirect delivery mode requires the SMTP forwarder")}
+	}
+
+	// Create the forwarded email; building it again gives the same result
+	forwardedEmail, err := BuildForwardMessage(f.userEmail, originalEmail, recipients, opts)
 	if err != nil {
-		return fmt.Errorf("failed to create forwarded email: %w", err)
+		return &PermanentError{Err: fmt.Errorf("failed to create forwarded email: %w", err)}
+	}
+
+	// Gmail delivers to the Bcc header and strips it before sending
+	if len(recipients.Bcc) > 0 {
+		forwardedEmail = fmt.Sprintf("Bcc: %s\r\n", strings.Join(recipients.Bcc, ", ")) + forwardedEmail
 	}
 
 	// Encode the email
@@ -582,91 +803,40 @@ func (f *EmailForwarder) ForwardEmail(ctx context.Context, originalEmail EmailMe
 		Raw: encodedEmail,
 	}
 
-	// Send the email with retry logic
-	var lastErr error
-	for attempt := 1; attempt <= 3; attempt++ {
-		_, err := f.service.Users.Messages.Send(f.userEmail, message).Do()
+	// Send the email, retrying rate limits and server errors with backoff
+	attempt := 1
+	for {
+		_, err := f.service.Users.Messages.Send(f.userEmail, message).Context(ctx).Do()
 		if err == nil {
-			logrus.Infof("Successfully forwarded email %s to %s", originalEmail.ID, targetEmail)
+			logrus.Infof("Successfully forwarded email %s to %s", originalEmail.ID, recipients)
 			return nil
 		}
 
-		lastErr = err
-		logrus.Warnf("Failed to forward email (attempt %d/%d): %v", attempt, 3, err)
-
-		// Check if it's a rate limit error
-		if strings.Contains(err.Error(), "quota") || strings.Contains(err.Error(), "rate") {
-			// Wait with exponential backoff
-			waitTime := time.Duration(attempt*attempt) * time.Second
-			logrus.Infof("Rate limited, waiting %v before retry", waitTime)
-			time.Sleep(waitTime)
-		} else {
-			// For other errors, don't retry
-			break
+		err, retry := ClassifyGmailError(err, time.Now())
+		if !retry || attempt == gmailSendAttempts {
+			return fmt.Errorf("failed to forward email after %d attempts: %w", attempt, err)
 		}
-	}
-
-	return fmt.Errorf("failed to forward email after 3 attempts: %w", lastErr)
-}
-
-// createForwardedEmail creates a forwarded email with proper headers
-func (f *EmailForwarder) createForwardedEmail(original EmailMessage, targetEmail string) (string, error) {
-	var emailBuilder strings.Builder
 
-	// Add headers
-	emailBuilder.WriteString(fmt.Sprintf("From: %s\r\n", f.userEmail))
-	emailBuilder.WriteString(fmt.Sprintf("To: %s\r\n", targetEmail))
-	emailBuilder.WriteString(fmt.Sprintf("Subject: Fwd: %s\r\n", original.Subject))
-	emailBuilder.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
-	emailBuilder.WriteString("MIME-Version: 1.0\r\n")
-	emailBuilder.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
-	emailBuilder.WriteString("Content-Transfer-Encoding: 7bit\r\n")
-
-	// Add original headers as references
-	if original.From != "" {
-		emailBuilder.WriteString(fmt.Sprintf("X-Original-From: %s\r\n", original.From))
-	}
-	if len(original.To) > 0 {
-		emailBuilder.WriteString(fmt.Sprintf("X-Original-To: %s\r\n", strings.Join(original.To, ", ")))
-	}
-	if len(original.CC) > 0 {
-		emailBuilder.WriteString(fmt.Sprintf("X-Original-Cc: %s\r\n", strings.Join(original.CC, ", ")))
-	}
-	emailBuilder.WriteString(fmt.Sprintf("X-Original-Message-ID: %s\r\n", original.ID))
-	emailBuilder.WriteString(fmt.Sprintf("X-Forwarded-At: %s\r\n", time.Now().Format(time.RFC3339)))
+		wait, ok := gmailRetryDelay(err, attempt)
+		if !ok {
+			// The server asked for a longer pause than is worth blocking
+			// for; the caller retries the forward once it has passed
+			return fmt.Errorf("failed to forward email after %d attempts: %w", attempt, err)
+		}
 
-	emailBuilder.WriteString("\r\n")
+		logrus.Warnf("Failed to forward email (attempt %d/%d), retrying in %v: %v", attempt, gmailSendAttempts, wait, err)
 
-	// Add forwarded content
-	emailBuilder.WriteString("---------- Forwarded message ----------\r\n")
-	emailBuilder.WriteString(fmt.Sprintf("From: %s\r\n", original.From))
-	if len(original.To) > 0 {
-		emailBuilder.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(original.To, ", ")))
-	}
-	if len(original.CC) > 0 {
-		emailBuilder.WriteString(fmt.Sprintf("Cc: %s\r\n", strings.Join(original.CC, ", ")))
-	}
-	emailBuilder.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
-	emailBuilder.WriteString(fmt.Sprintf("Subject: %s\r\n", original.Subject))
-	emailBuilder.WriteString(fmt.Sprintf("Message-ID: %s\r\n", original.ID))
-	emailBuilder.WriteString("\r\n")
-
-	// Add original body
-	if original.Body != "" {
-		emailBuilder.WriteString(original.Body)
-	} else if original.HTMLBody != "" {
-		// Convert HTML to plain text (simple approach)
-		plainText := f.htmlToPlainText(original.HTMLBody)
-		emailBuilder.WriteString(plainText)
-	} else {
-		emailBuilder.WriteString("[No text content available]\r\n")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to forward email after %d attempts: %w", attempt, err)
+		case <-time.After(wait):
+		}
+		attempt++
 	}
-
-	return emailBuilder.String(), nil
 }
 
 // htmlToPlainText converts HTML to plain text (simple implementation)
-func (f *EmailForwarder) htmlToPlainText(html string) string {
+func htmlToPlainText(html string) string {
 	// Remove HTML tags (simple approach)
 	// In a production environment, you might want to use a proper HTML parser
 	text := html
@@ -710,7 +880,7 @@ func (f *EmailForwarder) htmlToPlainText(html string) string {
 }
 
 // TestConnection tests the Gmail API connection
-func (f *EmailForwarder) TestConnection(ctx context.Context) error {
+func (f *GmailAPIForwarder) TestConnection(ctx context.Context) error {
 	// Try to get user profile to test connection
 	_, err := f.service.Users.GetProfile(f.userEmail).Do()
 	if err != nil {
@@ -720,6 +890,6 @@ func (f *EmailForwarder) TestConnection(ctx context.Context) error {
 }
 
 // Close closes the forwarder (no-op for Gmail API)
-func (f *EmailForwarder) Close() error {
+func (f *GmailAPIForwarder) Close() error {
 	return nil
 }
@@ -0,0 +1,431 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// parseMIMEMessage parses a raw RFC 5322 message and fills the headers, text
+// and HTML bodies, attachments and raw bytes of email. The parsed top-level
+// header is returned for callers that need structured access to it.
+func parseMIMEMessage(raw []byte, email *EmailMessage) (mail.Header, error) {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return mail.Header{}, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	email.Raw = raw
+	if email.Headers == nil {
+		email.Headers = make(map[string]string)
+	}
+
+	fields := entity.Header.Fields()
+	for fields.Next() {
+		if _, ok := email.Headers[fields.Key()]; ok {
+			continue
+		}
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		email.Headers[fields.Key()] = value
+	}
+
+	if err := parseMIMEPart(entity, email); err != nil {
+		return mail.Header{}, err
+	}
+
+	return mail.Header{Header: entity.Header}, nil
+}
+
+// addressList returns the addresses of an address header, falling back to a
+// plain comma split when the header cannot be parsed
+func addressList(header mail.Header, key string) []string {
+	value := header.Get(key)
+	if value == "" {
+		return nil
+	}
+
+	addrs, err := header.AddressList(key)
+	if err != nil {
+		return strings.Split(value, ",")
+	}
+
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Name == "" {
+			list = append(list, addr.Address)
+		} else {
+			list = append(list, addr.String())
+		}
+	}
+	return list
+}
+
+// parseMIMEPart walks a MIME entity tree. The first text/plain and text/html
+// parts that are not attachments become the bodies; every other leaf part is
+// kept as an attachment.
+func parseMIMEPart(entity *message.Entity, email *EmailMessage) error {
+	if mr := entity.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && !message.IsUnknownCharset(err) {
+				return fmt.Errorf("failed to read part: %w", err)
+			}
+
+			if err := parseMIMEPart(part, email); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read part body: %w", err)
+	}
+
+	contentType, typeParams, _ := entity.Header.ContentType()
+	if contentType == "" {
+		// RFC 2045 default for parts without a Content-Type
+		contentType = "text/plain"
+	}
+
+	disposition, dispositionParams, _ := entity.Header.ContentDisposition()
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = typeParams["name"]
+	}
+
+	isAttachment := disposition == "attachment" || filename != ""
+
+	switch {
+	case contentType == "text/plain" && !isAttachment && email.Body == "":
+		email.Body = string(content)
+	case contentType == "text/html" && !isAttachment && email.HTMLBody == "":
+		email.HTMLBody = string(content)
+	default:
+		email.Attachments = append(email.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: contentType,
+			ContentID:   strings.Trim(entity.Header.Get("Content-Id"), "<>"),
+			Inline:      disposition == "inline",
+			Data:        content,
+		})
+	}
+
+	return nil
+}
+
+// BuildForwardMessage renders the message sent to recipients for the delivery
+// mode in opts. Bcc recipients are never written to the message.
+func BuildForwardMessage(from string, original EmailMessage, recipients Recipients, opts ForwardOptions) (string, error) {
+	switch opts.Mode {
+	case "", model.DeliveryModeInline, model.DeliveryModeAttachment:
+		text, err := renderForwardText(original, opts)
+		if err != nil {
+			return "", err
+		}
+		if opts.Mode == model.DeliveryModeAttachment {
+			return createAttachedEmail(from, original, recipients, text)
+		}
+		return createForwardedEmail(from, original, recipients, text)
+	case model.DeliveryModeRedirect:
+		return createRedirectedEmail(from, original, recipients)
+	default:
+		return "", fmt.Errorf("unsupported delivery mode: %q", opts.Mode)
+	}
+}
+
+// forwardHeader returns the top-level header shared by forwarded emails
+func forwardHeader(from string, original EmailMessage, recipients Recipients, subject string) mail.Header {
+	var h mail.Header
+	h.Set("From", from)
+	if len(recipients.To) > 0 {
+		h.Set("To", strings.Join(recipients.To, ", "))
+	} else if len(recipients.Cc) == 0 {
+		h.Set("To", "undisclosed-recipients:;")
+	}
+	if len(recipients.Cc) > 0 {
+		h.Set("Cc", strings.Join(recipients.Cc, ", "))
+	}
+	h.SetSubject(subject)
+	h.SetDate(time.Now())
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("multipart/mixed", nil)
+
+	// Add original headers as references
+	if original.From != "" {
+		h.Set("X-Original-From", original.From)
+	}
+	if len(original.To) > 0 {
+		h.Set("X-Original-To", strings.Join(original.To, ", "))
+	}
+	if len(original.CC) > 0 {
+		h.Set("X-Original-Cc", strings.Join(original.CC, ", "))
+	}
+	h.Set("X-Original-Message-ID", original.ID)
+	h.Set("X-Forwarded-At", time.Now().Format(time.RFC3339))
+
+	return h
+}
+
+// createAttachedEmail creates a forwarded email that carries the untouched
+// original message as a message/rfc822 attachment, so its headers, DKIM
+// signatures and MIME structure arrive intact
+func createAttachedEmail(from string, original EmailMessage, recipients Recipients, text forwardText) (string, error) {
+	if len(original.Raw) == 0 {
+		return "", fmt.Errorf("raw message %s is not available", original.ID)
+	}
+
+	h := forwardHeader(from, original, recipients, text.subject)
+
+	var buf bytes.Buffer
+	mw, err := message.CreateWriter(&buf, h.Header)
+	if err != nil {
+		return "", fmt.Errorf("failed to create message writer: %w", err)
+	}
+
+	if err := writeTextPart(mw, "text/plain", "The original message is attached.\r\n\r\n"+text.headerText+text.footerText); err != nil {
+		return "", err
+	}
+
+	var partHeader message.Header
+	partHeader.SetContentType("message/rfc822", nil)
+	partHeader.SetContentDisposition("attachment", map[string]string{"filename": "original.eml"})
+	partHeader.Set("Content-Transfer-Encoding", "8bit")
+
+	w, err := mw.CreatePart(partHeader)
+	if err != nil {
+		return "", fmt.Errorf("failed to create message/rfc822 part: %w", err)
+	}
+	if _, err := w.Write(original.Raw); err != nil {
+		return "", fmt.Errorf("failed to write original message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to close message/rfc822 part: %w", err)
+	}
+
+	if err := mw.Close(); err != nil {
+		return "", fmt.Errorf("failed to close message: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// createRedirectedEmail creates a resent copy of the original message as
+// described in RFC 5322 section 3.6.6: the original From, Subject, Message-ID
+// and body are kept and a Resent-* block is prepended. The recipients only
+// appear in Resent-To and Resent-Cc, so the message must be delivered with
+// explicit envelope recipients.
+func createRedirectedEmail(from string, original EmailMessage, recipients Recipients) (string, error) {
+	if len(original.Raw) == 0 {
+		return "", fmt.Errorf("raw message %s is not available", original.ID)
+	}
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Resent-From: %s\r\n", from))
+	if len(recipients.To) > 0 {
+		b.WriteString(fmt.Sprintf("Resent-To: %s\r\n", strings.Join(recipients.To, ", ")))
+	}
+	if len(recipients.Cc) > 0 {
+		b.WriteString(fmt.Sprintf("Resent-Cc: %s\r\n", strings.Join(recipients.Cc, ", ")))
+	}
+	b.WriteString(fmt.Sprintf("Resent-Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	b.Write(original.Raw)
+
+	return b.String(), nil
+}
+
+// createForwardedEmail creates a forwarded email that keeps the original MIME
+// structure: a multipart/mixed message whose first part holds the plain and
+// HTML alternatives prefixed with the forward header, followed by every
+// attachment of the original message. Inline parts referenced from the HTML
+// body are grouped with it in a multipart/related part.
+func createForwardedEmail(from string, original EmailMessage, recipients Recipients, text forwardText) (string, error) {
+	h := forwardHeader(from, original, recipients, text.subject)
+
+	var buf bytes.Buffer
+	mw, err := message.CreateWriter(&buf, h.Header)
+	if err != nil {
+		return "", fmt.Errorf("failed to create message writer: %w", err)
+	}
+
+	var inline, attachments []Attachment
+	for _, attachment := range original.Attachments {
+		if attachment.Inline && attachment.ContentID != "" && original.HTMLBody != "" {
+			inline = append(inline, attachment)
+		} else {
+			attachments = append(attachments, attachment)
+		}
+	}
+
+	if len(inline) > 0 {
+		var relatedHeader message.Header
+		relatedHeader.SetContentType("multipart/related", map[string]string{"type": "multipart/alternative"})
+
+		related, err := mw.CreatePart(relatedHeader)
+		if err != nil {
+			return "", fmt.Errorf("failed to create related part: %w", err)
+		}
+		if err := writeForwardedBody(related, original, text); err != nil {
+			return "", err
+		}
+		for _, attachment := range inline {
+			if err := writeAttachment(related, attachment); err != nil {
+				return "", err
+			}
+		}
+		if err := related.Close(); err != nil {
+			return "", fmt.Errorf("failed to close related part: %w", err)
+		}
+	} else if err := writeForwardedBody(mw, original, text); err != nil {
+		return "", err
+	}
+
+	for _, attachment := range attachments {
+		if err := writeAttachment(mw, attachment); err != nil {
+			return "", err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return "", fmt.Errorf("failed to close message: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// writeForwardedBody writes the multipart/alternative body of a forwarded
+// email. The plain text alternative is always present; the HTML alternative
+// is added when the original has an HTML body.
+func writeForwardedBody(parent *message.Writer, original EmailMessage, text forwardText) error {
+	var altHeader message.Header
+	altHeader.SetContentType("multipart/alternative", nil)
+
+	alt, err := parent.CreatePart(altHeader)
+	if err != nil {
+		return fmt.Errorf("failed to create alternative part: %w", err)
+	}
+
+	plainBody, htmlBody := forwardBodies(original, text)
+
+	if err := writeTextPart(alt, "text/plain", plainBody); err != nil {
+		return err
+	}
+
+	if htmlBody != "" {
+		if err := writeTextPart(alt, "text/html", htmlBody); err != nil {
+			return err
+		}
+	}
+
+	if err := alt.Close(); err != nil {
+		return fmt.Errorf("failed to close alternative part: %w", err)
+	}
+	return nil
+}
+
+// forwardBodies returns the plain text and HTML bodies of a forwarded email:
+// the header block, the original body and the footer. The HTML body is empty
+// when the original has no HTML body.
+func forwardBodies(original EmailMessage, text forwardText) (string, string) {
+	plainBody := original.Body
+	if plainBody == "" && original.HTMLBody != "" {
+		plainBody = htmlToPlainText(original.HTMLBody)
+	}
+	if plainBody == "" {
+		plainBody = "[No text content available]\r\n"
+	}
+	plainBody = text.headerText + plainBody + text.footerText
+
+	var htmlBody string
+	if original.HTMLBody != "" {
+		htmlBody = text.headerHTML + original.HTMLBody + text.footerHTML
+	}
+
+	return plainBody, htmlBody
+}
+
+// forwardHeaderText returns the "Forwarded message" block placed above the
+// original body
+func forwardHeaderText(original EmailMessage) string {
+	var b strings.Builder
+
+	b.WriteString("---------- Forwarded message ----------\r\n")
+	b.WriteString(fmt.Sprintf("From: %s\r\n", original.From))
+	if len(original.To) > 0 {
+		b.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(original.To, ", ")))
+	}
+	if len(original.CC) > 0 {
+		b.WriteString(fmt.Sprintf("Cc: %s\r\n", strings.Join(original.CC, ", ")))
+	}
+	if date := original.Headers["Date"]; date != "" {
+		b.WriteString(fmt.Sprintf("Date: %s\r\n", date))
+	}
+	b.WriteString(fmt.Sprintf("Subject: %s\r\n", original.Subject))
+	b.WriteString(fmt.Sprintf("Message-ID: %s\r\n", original.ID))
+	b.WriteString("\r\n")
+
+	return b.String()
+}
+
+// writeTextPart writes a quoted-printable UTF-8 text part
+func writeTextPart(parent *message.Writer, contentType, content string) error {
+	var h message.Header
+	h.SetContentType(contentType, map[string]string{"charset": "UTF-8"})
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	w, err := parent.CreatePart(h)
+	if err != nil {
+		return fmt.Errorf("failed to create %s part: %w", contentType, err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		return fmt.Errorf("failed to write %s part: %w", contentType, err)
+	}
+	return w.Close()
+}
+
+// writeAttachment writes a base64 encoded attachment part
+func writeAttachment(parent *message.Writer, attachment Attachment) error {
+	var h message.Header
+
+	typeParams := map[string]string{}
+	dispositionParams := map[string]string{}
+	if attachment.Filename != "" {
+		typeParams["name"] = attachment.Filename
+		dispositionParams["filename"] = attachment.Filename
+	}
+
+	disposition := "attachment"
+	if attachment.Inline {
+		disposition = "inline"
+	}
+
+	h.SetContentType(attachment.ContentType, typeParams)
+	h.SetContentDisposition(disposition, dispositionParams)
+	h.Set("Content-Transfer-Encoding", "base64")
+	if attachment.ContentID != "" {
+		h.Set("Content-Id", "<"+attachment.ContentID+">")
+	}
+
+	w, err := parent.CreatePart(h)
+	if err != nil {
+		return fmt.Errorf("failed to create attachment part: %w", err)
+	}
+	if _, err := w.Write(attachment.Data); err != nil {
+		return fmt.Errorf("failed to write attachment %q: %w", attachment.Filename, err)
+	}
+	return w.Close()
+}
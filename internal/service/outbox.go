@@ -0,0 +1,374 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/config"
+	"smart-mail-relay-go/internal/model"
+)
+
+const (
+	// defaultRetryBaseDelay and defaultRetryMaxDelay bound the retry backoff
+	// when the scheduler configuration leaves them unset
+	defaultRetryBaseDelay = time.Minute
+	defaultRetryMaxDelay  = time.Hour
+	// defaultClaimTimeout is how long a claim is held when the scheduler
+	// configuration leaves it unset
+	defaultClaimTimeout = 10 * time.Minute
+)
+
+var (
+	// ErrJobNotDead is returned when retrying or dropping an outbox job that
+	// is not in the dead letter state
+	ErrJobNotDead = errors.New("outbox job is not dead")
+	// ErrClaimLost is returned when recording the outcome of an attempt
+	// whose claim has expired and been taken over by another attempt
+	ErrClaimLost = errors.New("outbox job claim was lost")
+)
+
+// OutboxMessage is the content of an outbox job needed to send it again
+type OutboxMessage struct {
+	Email      EmailMessage `json:"email"`
+	Recipients Recipients   `json:"recipients"`
+	Subject    SubjectParts `json:"subject"`
+}
+
+// Outbox persists the forwards that still have to be delivered, so failed
+// attempts are retried with backoff in later cycles whether or not the email
+// is fetched again
+type Outbox struct {
+	db     *gorm.DB
+	config *config.SchedulerConfig
+}
+
+// NewOutbox creates a new outbox. A nil cfg uses the default backoff and
+// never retries.
+func NewOutbox(db *gorm.DB, cfg *config.SchedulerConfig) *Outbox {
+	return &Outbox{
+		db:     db,
+		config: cfg,
+	}
+}
+
+// Enqueue queues a job for every match and marks the email as processed in
+// the same transaction, so a forward is neither lost nor queued twice
+func (o *Outbox) Enqueue(email EmailMessage, matches []RuleMatch) ([]model.OutboxJob, error) {
+	// The bodies and attachments of an email with its raw message are parsed
+	// from it again by DecodeJob, so they are not stored twice
+	stored := email
+	if len(stored.Raw) > 0 {
+		stored.Body, stored.HTMLBody, stored.Attachments = "", "", nil
+	}
+
+	now := time.Now()
+	jobs := make([]model.OutboxJob, 0, len(matches))
+	for _, match := range matches {
+		payload, err := json.Marshal(OutboxMessage{
+			Email:      stored,
+			Recipients: match.Recipients,
+			Subject:    match.Subject,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode outbox job: %w", err)
+		}
+
+		jobs = append(jobs, model.OutboxJob{
+			AccountID:     email.AccountID,
+			MessageID:     email.ID,
+			RuleID:        match.Rule.ID,
+			Subject:       truncate(email.Subject, 1024),
+			Status:        model.OutboxStatusPending,
+			NextAttemptAt: now,
+			Payload:       payload,
+		})
+	}
+
+	err := o.db.Transaction(func(tx *gorm.DB) error {
+		if len(jobs) > 0 {
+			if err := tx.Create(&jobs).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&model.ProcessedEmail{AccountID: email.AccountID, MessageID: email.ID, ProcessedAt: now}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue email %s: %w", email.ID, err)
+	}
+
+	return jobs, nil
+}
+
+// Due returns up to limit jobs that can be claimed at now, ordered by ID and
+// starting after the job with ID after: pending jobs whose next attempt is
+// due and jobs whose claim has expired
+func (o *Outbox) Due(now time.Time, after uint, limit int) ([]model.OutboxJob, error) {
+	var jobs []model.OutboxJob
+	result := o.db.Preload("Rule").
+		Where(o.claimable(now)).Where("id > ?", after).
+		Order("id").Limit(limit).Find(&jobs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get due outbox jobs: %w", result.Error)
+	}
+	return jobs, nil
+}
+
+// FirstWaiting returns, for each of the given rules that has one, the ID of
+// its oldest job that cannot be claimed at now: a pending job that is not due
+// yet, or a job that is being sent
+func (o *Outbox) FirstWaiting(now time.Time, ruleIDs []uint) (map[uint]uint, error) {
+	waiting := make(map[uint]uint)
+	if len(ruleIDs) == 0 {
+		return waiting, nil
+	}
+
+	var rows []struct {
+		RuleID uint
+		ID     uint
+	}
+	result := o.db.Model(&model.OutboxJob{}).Select("rule_id, MIN(id) AS id").
+		Where("rule_id IN ?", ruleIDs).
+		Where(o.db.Where("status = ? AND next_attempt_at > ?", model.OutboxStatusPending, now).
+			Or("status = ? AND claimed_at > ?", model.OutboxStatusProcessing, now.Add(-o.claimTimeout()))).
+		Group("rule_id").Scan(&rows)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get waiting outbox jobs: %w", result.Error)
+	}
+
+	for _, row := range rows {
+		waiting[row.RuleID] = row.ID
+	}
+	return waiting, nil
+}
+
+// DecodeJob returns the email and recipients stored in a job. The bodies and
+// attachments of an email are parsed from its raw message when it has one.
+func DecodeJob(job *model.OutboxJob) (*OutboxMessage, error) {
+	var msg OutboxMessage
+	if err := json.Unmarshal(job.Payload, &msg); err != nil {
+		return nil, fmt.Errorf("failed to decode outbox job %d: %w", job.ID, err)
+	}
+
+	if raw := msg.Email.Raw; len(raw) > 0 {
+		msg.Email.Body, msg.Email.HTMLBody, msg.Email.Attachments = "", "", nil
+		if _, err := parseMIMEMessage(raw, &msg.Email); err != nil {
+			return nil, fmt.Errorf("failed to parse message of outbox job %d: %w", job.ID, err)
+		}
+	}
+	return &msg, nil
+}
+
+// Claim takes a due job for one attempt before it is sent, so no other
+// attempt sends it at the same time. The job moves to the processing state
+// in a single conditional update, which fails if the job changed since it
+// was loaded; a claim that was not released within the claim timeout, e.g.
+// because the process crashed while sending, is taken over. Claiming counts
+// as an attempt. It reports whether the job was claimed.
+func (o *Outbox) Claim(job *model.OutboxJob) (bool, error) {
+	now := time.Now()
+	result := o.db.Model(&model.OutboxJob{}).
+		Where("id = ? AND attempts = ?", job.ID, job.Attempts).
+		Where(o.claimable(now)).
+		Updates(map[string]interface{}{
+			"status":     model.OutboxStatusProcessing,
+			"attempts":   gorm.Expr("attempts + 1"),
+			"claimed_at": now,
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim outbox job %d: %w", job.ID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	job.Status = model.OutboxStatusProcessing
+	job.Attempts++
+	job.ClaimedAt = &now
+	return true, nil
+}
+
+// MarkSent records a delivered job together with its forward log entry.
+// errorMsg describes recipients that were rejected, if any. The payload is
+// dropped as it is no longer needed.
+func (o *Outbox) MarkSent(job *model.OutboxJob, errorMsg string, log *model.ForwardLog) error {
+	job.Status = model.OutboxStatusSent
+	job.LastError = errorMsg
+	job.Payload = nil
+
+	return o.finish(job, log)
+}
+
+// MarkFailed records a failed attempt together with its forward log entry and
+// schedules the next one after the retry delay, or after the Retry-After of a
+// *RetryAfterError if that is longer. Once MaxRetries retries have failed it
+// moves the job to the dead letter state instead. It reports whether the job
+// is dead.
+func (o *Outbox) MarkFailed(job *model.OutboxJob, cause error, log *model.ForwardLog) (bool, error) {
+	job.Status = model.OutboxStatusPending
+	job.LastError = cause.Error()
+	if job.Attempts > o.maxRetries() {
+		job.Status = model.OutboxStatusDead
+	} else {
+		delay := o.RetryDelay(job.Attempts)
+		if retryAfter := RetryAfter(cause); retryAfter > delay {
+			delay = retryAfter
+		}
+		job.NextAttemptAt = time.Now().Add(delay)
+	}
+
+	return job.Status == model.OutboxStatusDead, o.finish(job, log)
+}
+
+// MarkDead moves a job that can never be delivered to the dead letter state
+// without further retries and records its forward log entry
+func (o *Outbox) MarkDead(job *model.OutboxJob, cause error, log *model.ForwardLog) error {
+	job.Status = model.OutboxStatusDead
+	job.LastError = cause.Error()
+
+	return o.finish(job, log)
+}
+
+// RetryDelay returns the delay before the retry that follows the given
+// number of failed attempts: the base delay doubled for every attempt after
+// the first, capped at the maximum delay
+func (o *Outbox) RetryDelay(attempts int) time.Duration {
+	base, max := defaultRetryBaseDelay, defaultRetryMaxDelay
+	if o.config != nil {
+		if o.config.RetryBaseDelay > 0 {
+			base = o.config.RetryBaseDelay
+		}
+		if o.config.RetryMaxDelay > 0 {
+			max = o.config.RetryMaxDelay
+		}
+	}
+
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Retry moves a dead job back to the queue with a fresh set of attempts
+func (o *Outbox) Retry(id uint) (*model.OutboxJob, error) {
+	job, err := o.deadJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Status = model.OutboxStatusPending
+	job.Attempts = 0
+	job.NextAttemptAt = time.Now()
+
+	if err := o.update(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Drop deletes a dead job
+func (o *Outbox) Drop(id uint) error {
+	job, err := o.deadJob(id)
+	if err != nil {
+		return err
+	}
+
+	if err := o.db.Delete(job).Error; err != nil {
+		return fmt.Errorf("failed to drop outbox job %d: %w", id, err)
+	}
+	return nil
+}
+
+// deadJob loads a job and checks that it is in the dead letter state
+func (o *Outbox) deadJob(id uint) (*model.OutboxJob, error) {
+	var job model.OutboxJob
+	if err := o.db.First(&job, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get outbox job %d: %w", id, err)
+	}
+
+	if job.Status != model.OutboxStatusDead {
+		return nil, ErrJobNotDead
+	}
+	return &job, nil
+}
+
+// finish releases the claim of a job by saving its new state, and writes the
+// forward log entry of the attempt in the same transaction. Nothing is written
+// if the claim has been taken over in the meantime, as the attempt that took
+// it records the outcome of the job.
+func (o *Outbox) finish(job *model.OutboxJob, log *model.ForwardLog) error {
+	err := o.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(job).
+			Where("status = ? AND attempts = ?", model.OutboxStatusProcessing, job.Attempts).
+			Select("Status", "NextAttemptAt", "LastError", "Payload").Updates(job)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrClaimLost
+		}
+		return tx.Create(log).Error
+	})
+	if errors.Is(err, ErrClaimLost) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update outbox job %d: %w", job.ID, err)
+	}
+	return nil
+}
+
+// claimable returns the condition matching the jobs that can be claimed at
+// now
+func (o *Outbox) claimable(now time.Time) *gorm.DB {
+	return o.db.Where("status = ? AND next_attempt_at <= ?", model.OutboxStatusPending, now).
+		Or("status = ? AND claimed_at <= ?", model.OutboxStatusProcessing, now.Add(-o.claimTimeout()))
+}
+
+// update saves the state of a job. Zero values such as a cleared error or
+// payload are written as well.
+func (o *Outbox) update(job *model.OutboxJob) error {
+	result := o.db.Model(job).Select("Status", "Attempts", "NextAttemptAt", "LastError", "Payload").Updates(job)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update outbox job %d: %w", job.ID, result.Error)
+	}
+	return nil
+}
+
+// claimTimeout returns how long a claim is held before it can be taken over
+func (o *Outbox) claimTimeout() time.Duration {
+	if o.config == nil || o.config.ClaimTimeout <= 0 {
+		return defaultClaimTimeout
+	}
+	return o.config.ClaimTimeout
+}
+
+// maxRetries returns the number of retries after the first attempt
+func (o *Outbox) maxRetries() int {
+	if o.config == nil || o.config.MaxRetries < 0 {
+		return 0
+	}
+	return o.config.MaxRetries
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 sequence
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// Recipients lists the addresses a forwarded email is delivered to. To and Cc
+// addresses appear in the message header; Bcc addresses only receive it.
+type Recipients struct {
+	To  []string
+	Cc  []string
+	Bcc []string
+}
+
+// RuleRecipients returns the recipients of a rule: the contact resolved from
+// the subject (if any) and the rule's TargetEmail as the first To addresses,
+// followed by its targets. Addresses listed more than once are only kept in
+// their first role.
+func RuleRecipients(rule *model.ForwardRule, contact *model.Contact) Recipients {
+	var r Recipients
+	seen := make(map[string]bool)
+
+	add := func(email, role string) {
+		email = strings.TrimSpace(email)
+		key := strings.ToLower(email)
+		if email == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+
+		switch role {
+		case model.RecipientRoleCc:
+			r.Cc = append(r.Cc, email)
+		case model.RecipientRoleBcc:
+			r.Bcc = append(r.Bcc, email)
+		default:
+			r.To = append(r.To, email)
+		}
+	}
+
+	if contact != nil {
+		add(contact.Email, model.RecipientRoleTo)
+	}
+	add(rule.TargetEmail, model.RecipientRoleTo)
+	for _, target := range rule.Targets {
+		add(target.Email, target.Role)
+	}
+
+	return r
+}
+
+// All returns every recipient address, To first, then Cc, then Bcc
+func (r Recipients) All() []string {
+	all := make([]string, 0, len(r.To)+len(r.Cc)+len(r.Bcc))
+	all = append(all, r.To...)
+	all = append(all, r.Cc...)
+	return append(all, r.Bcc...)
+}
+
+// String returns the recipients for log messages
+func (r Recipients) String() string {
+	return strings.Join(r.All(), ", ")
+}
+
+// RecipientError is returned by EmailForwarder.ForwardEmail when the message
+// was delivered but some of the recipients were rejected
+type RecipientError struct {
+	// Rejected maps each rejected address to the server's error
+	Rejected map[string]error
+}
+
+func (e *RecipientError) Error() string {
+	addresses := make([]string, 0, len(e.Rejected))
+	for address := range e.Rejected {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	parts := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		parts = append(parts, fmt.Sprintf("%s: %v", address, e.Rejected[address]))
+	}
+	return "recipients rejected: " + strings.Join(parts, "; ")
+}
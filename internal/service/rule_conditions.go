@@ -0,0 +1,140 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// ValidateCondition checks that a rule condition is complete and that its
+// value is valid for its operator
+func ValidateCondition(cond *model.RuleCondition) error {
+	switch cond.Field {
+	case model.ConditionFieldFrom, model.ConditionFieldFromDomain, model.ConditionFieldTo,
+		model.ConditionFieldCc, model.ConditionFieldBody:
+	case model.ConditionFieldHeader:
+		if strings.TrimSpace(cond.Header) == "" {
+			return errors.New("header conditions require a header name")
+		}
+	default:
+		return fmt.Errorf("unsupported condition field: %q", cond.Field)
+	}
+
+	if cond.Value == "" {
+		return fmt.Errorf("%s condition requires a value", cond.Field)
+	}
+
+	switch cond.Operator {
+	case "", model.ConditionOpEquals, model.ConditionOpContains:
+		return nil
+	case model.ConditionOpRegex:
+		if _, err := compileRuleRegex(cond.Value); err != nil {
+			return fmt.Errorf("invalid regular expression %q: %w", cond.Value, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported condition operator: %q", cond.Operator)
+	}
+}
+
+// MatchesConditions reports whether the conditions of a rule match an email.
+// Conditions are combined with AND unless the rule uses OR logic; a rule
+// without conditions always matches.
+func MatchesConditions(rule *model.ForwardRule, email EmailMessage) bool {
+	if len(rule.Conditions) == 0 {
+		return true
+	}
+
+	anyMatch := rule.ConditionLogic == model.ConditionLogicOr
+	for i := range rule.Conditions {
+		if matchCondition(&rule.Conditions[i], email) == anyMatch {
+			return anyMatch
+		}
+	}
+	return !anyMatch
+}
+
+// matchCondition evaluates a single condition against an email. Address
+// conditions on To and Cc match when any of the recipients matches.
+func matchCondition(cond *model.RuleCondition, email EmailMessage) bool {
+	switch cond.Field {
+	case model.ConditionFieldFrom:
+		return matchConditionValue(cond, bareAddress(email.From))
+	case model.ConditionFieldFromDomain:
+		return matchConditionValue(cond, addressDomain(bareAddress(email.From)))
+	case model.ConditionFieldTo:
+		return matchAnyAddress(cond, email.To)
+	case model.ConditionFieldCc:
+		return matchAnyAddress(cond, email.CC)
+	case model.ConditionFieldHeader:
+		value, ok := headerValue(email.Headers, cond.Header)
+		return ok && matchConditionValue(cond, value)
+	case model.ConditionFieldBody:
+		body := email.Body
+		if body == "" && email.HTMLBody != "" {
+			body = htmlToPlainText(email.HTMLBody)
+		}
+		return matchConditionValue(cond, body)
+	default:
+		return false
+	}
+}
+
+// matchAnyAddress reports whether any address of a list matches a condition
+func matchAnyAddress(cond *model.RuleCondition, addresses []string) bool {
+	for _, address := range addresses {
+		if matchConditionValue(cond, bareAddress(address)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchConditionValue applies the condition operator to a value. Equals and
+// contains ignore case; regex is case-sensitive unless the pattern uses (?i).
+func matchConditionValue(cond *model.RuleCondition, value string) bool {
+	switch cond.Operator {
+	case "", model.ConditionOpEquals:
+		return strings.EqualFold(strings.TrimSpace(value), strings.TrimSpace(cond.Value))
+	case model.ConditionOpContains:
+		return strings.Contains(strings.ToLower(value), strings.ToLower(cond.Value))
+	case model.ConditionOpRegex:
+		re, err := compileRuleRegex(cond.Value)
+		return err == nil && re.MatchString(value)
+	default:
+		return false
+	}
+}
+
+// bareAddress strips the display name from an address such as
+// "Jane <jane@example.com>"
+func bareAddress(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+	return strings.TrimSpace(address)
+}
+
+// addressDomain returns the domain part of an email address
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return ""
+}
+
+// headerValue looks up a header by name, ignoring case
+func headerValue(headers map[string]string, name string) (string, bool) {
+	if value, ok := headers[name]; ok {
+		return value, true
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// matchTypePrecedence orders match types from most to least specific
+var matchTypePrecedence = map[string]int{
+	model.MatchTypeExact:  0,
+	model.MatchTypePrefix: 1,
+	model.MatchTypeGlob:   2,
+	model.MatchTypeRegex:  3,
+}
+
+// regexCache holds compiled rule regular expressions keyed by pattern
+var regexCache sync.Map
+
+// ValidateKeywordPattern checks that a rule keyword is valid for its match type
+func ValidateKeywordPattern(matchType, keyword string) error {
+	switch matchType {
+	case "", model.MatchTypeExact, model.MatchTypePrefix:
+		return nil
+	case model.MatchTypeGlob:
+		if _, err := path.Match(strings.ToLower(keyword), ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %q: %w", keyword, err)
+		}
+		return nil
+	case model.MatchTypeRegex:
+		if _, err := compileRuleRegex(keyword); err != nil {
+			return fmt.Errorf("invalid regular expression %q: %w", keyword, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported match type: %q", matchType)
+	}
+}
+
+// MatchesKeyword reports whether a rule matches an extracted subject keyword.
+// Exact, prefix and glob rules ignore case; regex rules are case-sensitive
+// unless the pattern uses the (?i) flag.
+func MatchesKeyword(rule *model.ForwardRule, keyword string) bool {
+	switch rule.MatchType {
+	case "", model.MatchTypeExact:
+		return strings.EqualFold(rule.Keyword, keyword)
+	case model.MatchTypePrefix:
+		return strings.HasPrefix(strings.ToLower(keyword), strings.ToLower(rule.Keyword))
+	case model.MatchTypeGlob:
+		matched, err := path.Match(strings.ToLower(rule.Keyword), strings.ToLower(keyword))
+		return err == nil && matched
+	case model.MatchTypeRegex:
+		re, err := compileRuleRegex(rule.Keyword)
+		return err == nil && re.MatchString(keyword)
+	default:
+		return false
+	}
+}
+
+// RuleMatch is a rule selected for an email together with the recipients it
+// delivers to and the parsed subject it matched
+type RuleMatch struct {
+	Rule       model.ForwardRule
+	Recipients Recipients
+	Subject    SubjectParts
+}
+
+// SelectRules returns the rules to apply to an email, in order. contact is the
+// address book entry for the recipient name in the subject, or nil if there is
+// none. Disabled rules are skipped. Matching rules are sorted by ascending
+// priority, then by specificity (see ruleLess). Rules are taken in that order
+// up to and including the first one that does not have Continue set.
+func SelectRules(rules []model.ForwardRule, email EmailMessage, keyword string, contact *model.Contact) []RuleMatch {
+	var candidates []*model.ForwardRule
+	for i := range rules {
+		if ruleMatches(&rules[i], email, keyword, contact) {
+			candidates = append(candidates, &rules[i])
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return ruleLess(candidates[i], candidates[j])
+	})
+
+	var selected []RuleMatch
+	for _, rule := range candidates {
+		var ruleContact *model.Contact
+		if rule.ResolveRecipient {
+			ruleContact = contact
+		}
+
+		selected = append(selected, RuleMatch{
+			Rule:       *rule,
+			Recipients: RuleRecipients(rule, ruleContact),
+		})
+		if !rule.Continue {
+			break
+		}
+	}
+
+	return selected
+}
+
+// AppliesToAccount reports whether a rule applies to the emails of a mail
+// account: rules without accounts apply to every mailbox
+func AppliesToAccount(rule *model.ForwardRule, accountID uint) bool {
+	if len(rule.Accounts) == 0 {
+		return true
+	}
+	for _, account := range rule.Accounts {
+		if account.AccountID == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleMatches reports whether a rule is enabled and applies to the mail
+// account of an email, whether its keyword and conditions match the email, and
+// whether its recipient could be resolved if it needs one
+func ruleMatches(rule *model.ForwardRule, email EmailMessage, keyword string, contact *model.Contact) bool {
+	if !rule.Enabled {
+		return false
+	}
+	if !AppliesToAccount(rule, email.AccountID) {
+		return false
+	}
+	if rule.Keyword != "" && (keyword == "" || !MatchesKeyword(rule, keyword)) {
+		return false
+	}
+	if rule.Keyword == "" && len(rule.Conditions) == 0 {
+		return false
+	}
+	if rule.ResolveRecipient && contact == nil {
+		return false
+	}
+	return MatchesConditions(rule, email)
+}
+
+// ruleLess orders matching rules from most to least specific. Rules with a
+// keyword rank before rules matching on conditions only; keyword rules are
+// ranked by match type (exact, prefix, glob, regex), then by the longest
+// keyword for prefix rules. Remaining ties go to the rule with the most
+// conditions, then the lowest rule ID.
+func ruleLess(a, b *model.ForwardRule) bool {
+	if (a.Keyword == "") != (b.Keyword == "") {
+		return a.Keyword != ""
+	}
+	pa, pb := matchTypePrecedence[normalizeMatchType(a.MatchType)], matchTypePrecedence[normalizeMatchType(b.MatchType)]
+	if pa != pb {
+		return pa < pb
+	}
+	if normalizeMatchType(a.MatchType) == model.MatchTypePrefix && len(a.Keyword) != len(b.Keyword) {
+		return len(a.Keyword) > len(b.Keyword)
+	}
+	if len(a.Conditions) != len(b.Conditions) {
+		return len(a.Conditions) > len(b.Conditions)
+	}
+	return a.ID < b.ID
+}
+
+// normalizeMatchType maps an empty match type to the exact default
+func normalizeMatchType(matchType string) string {
+	if matchType == "" {
+		return model.MatchTypeExact
+	}
+	return matchType
+}
+
+// compileRuleRegex compiles a rule regular expression, reusing earlier results
+func compileRuleRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexCache.Store(pattern, re)
+	return re, nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// defaultRunHistory is the number of runs kept when no limit is configured
+const defaultRunHistory = 100
+
+// RunHistory persists the processing cycles of the scheduler and keeps the
+// most recent ones
+type RunHistory struct {
+	db    *gorm.DB
+	limit int
+}
+
+// NewRunHistory creates a new run history that keeps the last limit runs
+func NewRunHistory(db *gorm.DB, limit int) *RunHistory {
+	if limit <= 0 {
+		limit = defaultRunHistory
+	}
+
+	return &RunHistory{
+		db:    db,
+		limit: limit,
+	}
+}
+
+// Start records a new running cycle of a mail account
+func (h *RunHistory) Start(trigger string, accountID uint) (*model.SchedulerRun, error) {
+	run := model.SchedulerRun{
+		AccountID: accountID,
+		Trigger:   trigger,
+		State:     model.RunStateRunning,
+		StartedAt: time.Now(),
+	}
+
+	if err := h.db.Create(&run).Error; err != nil {
+		return nil, fmt.Errorf("failed to record scheduler run: %w", err)
+	}
+	return &run, nil
+}
+
+// Finish saves the final state of a run and removes the runs that no longer
+// fit in the history
+func (h *RunHistory) Finish(run *model.SchedulerRun) error {
+	if err := h.db.Save(run).Error; err != nil {
+		return fmt.Errorf("failed to save scheduler run %d: %w", run.ID, err)
+	}
+
+	var oldest []uint
+	result := h.db.Model(&model.SchedulerRun{}).Order("id DESC").Offset(h.limit).Limit(1).Pluck("id", &oldest)
+	if result.Error != nil {
+		return fmt.Errorf("failed to prune scheduler runs: %w", result.Error)
+	}
+	if len(oldest) > 0 {
+		if err := h.db.Where("id <= ?", oldest[0]).Delete(&model.SchedulerRun{}).Error; err != nil {
+			return fmt.Errorf("failed to prune scheduler runs: %w", err)
+		}
+	}
+	return nil
+}
+
+// Get returns a run by ID, or nil if it does not exist
+func (h *RunHistory) Get(id uint) (*model.SchedulerRun, error) {
+	var run model.SchedulerRun
+	if err := h.db.First(&run, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get scheduler run %d: %w", id, err)
+	}
+	return &run, nil
+}
+
+// List returns the kept runs, most recent first
+func (h *RunHistory) List() ([]model.SchedulerRun, error) {
+	var runs []model.SchedulerRun
+	if err := h.db.Order("id DESC").Limit(h.limit).Find(&runs).Error; err != nil {
+		return nil, fmt.Errorf("failed to list scheduler runs: %w", err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,285 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"smart-mail-relay-go/internal/model"
+)
+
+// Processing cycle triggers
+const (
+	TriggerSchedule = "schedule"
+	TriggerPush     = "push"
+	TriggerManual   = "manual"
+)
+
+// maxRunErrors caps the number of error messages kept for a run
+const maxRunErrors = 50
+
+var (
+	// ErrCycleActive is returned by RunOnce when it is asked not to join a
+	// processing cycle that is already in progress
+	ErrCycleActive = errors.New("a processing cycle is already in progress")
+	// ErrNotRunning is returned by RunOnce when the scheduler is stopped
+	ErrNotRunning = errors.New("scheduler is not running")
+	// ErrNotLeader is returned when a cycle is started on a replica that is
+	// not the elected leader
+	ErrNotLeader = errors.New("this instance is not the scheduler leader")
+	// ErrUnknownAccount is returned by RunOnce for a mail account that does
+	// not exist or is disabled
+	ErrUnknownAccount = errors.New("unknown mail account")
+)
+
+// CycleInfo describes a processing cycle in progress
+type CycleInfo struct {
+	RunID     uint      `json:"run_id"`
+	AccountID uint      `json:"account_id"`
+	Account   string    `json:"account"`
+	Trigger   string    `json:"trigger"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// cycle is a processing cycle of a pipeline in progress. done is closed when
+// it ends.
+type cycle struct {
+	info     CycleInfo
+	pipeline *pipeline
+	// ctx is cancelled when the pipeline stops or this instance loses the
+	// scheduler leadership
+	ctx    context.Context
+	cancel context.CancelFunc
+	// successor is the pipeline that replaced the retired pipeline of the
+	// cycle; the cycle is its active cycle too until it ends
+	successor *pipeline
+	run       *model.SchedulerRun
+	stats     runStats
+	done      chan struct{}
+}
+
+// runStats counts the work of a processing cycle. It is updated concurrently
+// by the workers.
+type runStats struct {
+	fetched     atomic.Int64
+	matched     atomic.Int64
+	forwarded   atomic.Int64
+	failed      atomic.Int64
+	fetchFailed atomic.Bool
+
+	mu      sync.Mutex
+	errors  []string
+	dropped int
+}
+
+// addError records an error message, keeping at most maxRunErrors of them
+func (r *runStats) addError(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.errors) >= maxRunErrors {
+		r.dropped++
+		return
+	}
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// snapshot returns the run of the cycle with the counts so far
+func (c *cycle) snapshot() model.SchedulerRun {
+	run := *c.run
+	run.Fetched = int(c.stats.fetched.Load())
+	run.Matched = int(c.stats.matched.Load())
+	run.Forwarded = int(c.stats.forwarded.Load())
+	run.Failed = int(c.stats.failed.Load())
+
+	c.stats.mu.Lock()
+	run.Errors = append([]string(nil), c.stats.errors...)
+	if c.stats.dropped > 0 {
+		run.Errors = append(run.Errors, fmt.Sprintf("and %d more errors", c.stats.dropped))
+	}
+	c.stats.mu.Unlock()
+
+	return run
+}
+
+// beginCycle records a new processing cycle of a pipeline and marks it as
+// active. Only one cycle of a pipeline runs at a time: if one is already
+// active, it is returned with started set to false.
+func (s *Scheduler) beginCycle(p *pipeline, trigger string) (c *cycle, started bool, err error) {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	if p.active != nil {
+		return p.active, false, nil
+	}
+
+	if p.ctx.Err() != nil {
+		return nil, false, ErrNotRunning
+	}
+
+	if !s.IsLeader() {
+		return nil, false, ErrNotLeader
+	}
+
+	run, err := s.runs.Start(trigger, p.accountID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.active = &cycle{
+		info: CycleInfo{
+			RunID:     run.ID,
+			AccountID: p.accountID,
+			Account:   p.name,
+			Trigger:   trigger,
+			StartedAt: run.StartedAt,
+		},
+		pipeline: p,
+		ctx:      ctx,
+		cancel:   cancel,
+		run:      run,
+		done:     make(chan struct{}),
+	}
+	return p.active, true, nil
+}
+
+// endCycle saves the outcome of an active processing cycle and marks it as
+// finished
+func (s *Scheduler) endCycle(c *cycle) {
+	run := c.snapshot()
+	finished := time.Now()
+	run.FinishedAt = &finished
+
+	switch {
+	case c.ctx.Err() != nil:
+		run.State = model.RunStateCancelled
+	case c.stats.fetchFailed.Load():
+		run.State = model.RunStateFailed
+	default:
+		run.State = model.RunStateCompleted
+	}
+
+	if err := s.runs.Finish(&run); err != nil {
+		logrus.Errorf("Failed to save processing cycle: %v", err)
+	}
+	c.cancel()
+
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	c.pipeline.active = nil
+	if c.successor != nil && c.successor.active == c {
+		c.successor.active = nil
+	}
+	close(c.done)
+}
+
+// runCycle runs a processing cycle of a pipeline unless one is already in
+// progress. It reports whether the cycle ran, and otherwise returns the active
+// cycle.
+func (s *Scheduler) runCycle(p *pipeline, trigger string) (*cycle, bool, error) {
+	c, started, err := s.beginCycle(p, trigger)
+	if err != nil || !started {
+		return c, false, err
+	}
+	defer s.endCycle(c)
+
+	s.processEmails(c)
+	return c, true, nil
+}
+
+// runScheduledCycle is the cron job of a pipeline. A scheduled cycle is
+// skipped while the previous one of the pipeline is still running.
+func (s *Scheduler) runScheduledCycle(p *pipeline) {
+	active, ran, err := s.runCycle(p, TriggerSchedule)
+	if errors.Is(err, ErrNotLeader) {
+		logrus.Debug("Skipping scheduled processing cycle, this instance is not the leader")
+		return
+	}
+	if errors.Is(err, ErrNotRunning) {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to start scheduled processing cycle of %s: %v", p.name, err)
+		return
+	}
+	if !ran {
+		logrus.Infof("Skipping scheduled processing cycle of %s, a %s cycle started at %s is still running",
+			p.name, active.info.Trigger, active.info.StartedAt.Format(time.RFC3339))
+	}
+}
+
+// activeCycles returns the processing cycles in progress
+func (s *Scheduler) activeCycles() []*cycle {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	var cycles []*cycle
+	for _, p := range s.pipelines {
+		if p.active != nil {
+			cycles = append(cycles, p.active)
+		}
+	}
+	return cycles
+}
+
+// cancelCycles cancels the processing cycles in progress, recording reason in
+// their runs
+func (s *Scheduler) cancelCycles(reason string) {
+	for _, c := range s.activeCycles() {
+		c.stats.addError("%s", reason)
+		c.cancel()
+	}
+}
+
+// GetRun returns a processing cycle by run ID, with the progress so far if it
+// is still running, or nil if it is not in the history
+func (s *Scheduler) GetRun(id uint) (*model.SchedulerRun, error) {
+	for _, c := range s.activeCycles() {
+		if c.run.ID == id {
+			run := c.snapshot()
+			return &run, nil
+		}
+	}
+
+	return s.runs.Get(id)
+}
+
+// ListRuns returns the processing cycles in the history, most recent first
+func (s *Scheduler) ListRuns() ([]model.SchedulerRun, error) {
+	runs, err := s.runs.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range s.activeCycles() {
+		for i := range runs {
+			if runs[i].ID == c.run.ID {
+				runs[i] = c.snapshot()
+			}
+		}
+	}
+	return runs, nil
+}
+
+// ActiveCycles returns the processing cycles in progress, ordered by run ID
+func (s *Scheduler) ActiveCycles() []CycleInfo {
+	cycles := s.activeCycles()
+	infos := make([]CycleInfo, 0, len(cycles))
+	for _, c := range cycles {
+		infos = append(infos, c.info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].RunID < infos[j].RunID
+	})
+	return infos
+}
@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LeaderInfo identifies the replica that runs the processing cycles
+type LeaderInfo struct {
+	InstanceID string    `json:"instance_id"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// campaign acquires and renews the scheduler lease until the scheduler stops,
+// then releases it so another replica can take over right away. The lease is
+// renewed three times per TTL; an instance that fails to renew it stops
+// its cycles immediately. The leader reloads the schedule and the mail
+// accounts whenever it takes or renews the lease, so it applies the changes
+// made through other replicas. done is closed once the lease is released.
+func (s *Scheduler) campaign(ctx context.Context, done chan struct{}) {
+	defer s.wg.Done()
+	defer close(done)
+
+	ticker := time.NewTicker(s.elector.TTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		s.renewLeadership()
+		if s.leader.Load() {
+			s.sync()
+		}
+
+		select {
+		case <-ctx.Done():
+			s.leader.Store(false)
+			if err := s.elector.Release(); err != nil {
+				logrus.Errorf("Failed to release scheduler leadership: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewLeadership takes or renews the scheduler lease and logs leadership
+// changes. Losing the lease cancels the cycles in progress, since another
+// replica may take over before they end.
+func (s *Scheduler) renewLeadership() {
+	leader, err := s.elector.TryAcquire()
+	if err != nil {
+		logrus.Errorf("Failed to renew scheduler leadership: %v", err)
+	}
+
+	switch wasLeader := s.leader.Swap(leader); {
+	case leader && !wasLeader:
+		logrus.Infof("Acquired scheduler leadership as %s", s.elector.ID())
+	case !leader && wasLeader:
+		logrus.Warnf("Lost scheduler leadership as %s, cancelling processing cycles in progress", s.elector.ID())
+		s.cancelCycles("Cancelled, this instance lost the scheduler leadership")
+	}
+}
+
+// IsLeader reports whether this instance runs the processing cycles. Without
+// leader election every instance does.
+func (s *Scheduler) IsLeader() bool {
+	if s.elector == nil {
+		return true
+	}
+	return s.leader.Load()
+}
+
+// InstanceID returns the identity of this instance in the leader election, or
+// an empty string if leader election is disabled
+func (s *Scheduler) InstanceID() string {
+	if s.elector == nil {
+		return ""
+	}
+	return s.elector.ID()
+}
+
+// Leader returns the replica currently holding the scheduler lease, or nil if
+// leader election is disabled or no replica holds it
+func (s *Scheduler) Leader() (*LeaderInfo, error) {
+	if s.elector == nil {
+		return nil, nil
+	}
+
+	lease, err := s.elector.Leader()
+	if err != nil || lease == nil {
+		return nil, err
+	}
+	return &LeaderInfo{InstanceID: lease.Holder, ExpiresAt: lease.ExpiresAt}, nil
+}
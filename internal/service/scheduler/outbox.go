@@ -0,0 +1,219 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"smart-mail-relay-go/internal/model"
+	service "smart-mail-relay-go/internal/service"
+)
+
+// outboxBatchSize is the number of due outbox jobs loaded at a time
+const outboxBatchSize = 100
+
+// deliveryLane is a sequence of outbox jobs delivered one after another by a
+// single worker
+type deliveryLane struct {
+	jobs []*model.OutboxJob
+	// ordered lanes hold the jobs of a rule with OrderedDelivery and stop at
+	// the first job that has to wait for a retry
+	ordered bool
+}
+
+// deliverOutbox sends every outbox job that is due, delivering the lanes of
+// each batch concurrently, until ctx is cancelled
+func (s *Scheduler) deliverOutbox(ctx context.Context, stats *runStats) {
+	var after uint
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		now := time.Now()
+		jobs, err := s.outbox.Due(now, after, outboxBatchSize)
+		if err != nil {
+			logrus.Errorf("Failed to load outbox: %v", err)
+			stats.addError("%v", err)
+			return
+		}
+		if len(jobs) == 0 {
+			return
+		}
+
+		lanes, err := s.deliveryLanes(now, jobs)
+		if err != nil {
+			logrus.Errorf("Failed to load outbox: %v", err)
+			stats.addError("%v", err)
+			return
+		}
+
+		s.runWorkers(len(lanes), func(i int) {
+			s.deliverLane(ctx, lanes[i], stats)
+		})
+
+		after = jobs[len(jobs)-1].ID
+		if len(jobs) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// deliveryLanes splits due jobs into lanes. Every job gets its own lane,
+// except that the jobs of a rule with OrderedDelivery share one lane in ID
+// order. Those that come after an earlier job of the rule still waiting for
+// its retry are left out, so they are not sent ahead of it.
+func (s *Scheduler) deliveryLanes(now time.Time, jobs []model.OutboxJob) ([]*deliveryLane, error) {
+	var lanes []*deliveryLane
+	ordered := make(map[uint]*deliveryLane)
+	for i := range jobs {
+		job := &jobs[i]
+		if job.Rule == nil || !job.Rule.OrderedDelivery {
+			lanes = append(lanes, &deliveryLane{jobs: []*model.OutboxJob{job}})
+			continue
+		}
+
+		lane, ok := ordered[job.RuleID]
+		if !ok {
+			lane = &deliveryLane{ordered: true}
+			ordered[job.RuleID] = lane
+			lanes = append(lanes, lane)
+		}
+		lane.jobs = append(lane.jobs, job)
+	}
+
+	if len(ordered) == 0 {
+		return lanes, nil
+	}
+
+	ruleIDs := make([]uint, 0, len(ordered))
+	for id := range ordered {
+		ruleIDs = append(ruleIDs, id)
+	}
+	waiting, err := s.outbox.FirstWaiting(now, ruleIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for ruleID, lane := range ordered {
+		first, ok := waiting[ruleID]
+		if !ok {
+			continue
+		}
+		n := 0
+		for n < len(lane.jobs) && lane.jobs[n].ID < first {
+			n++
+		}
+		lane.jobs = lane.jobs[:n]
+	}
+	return lanes, nil
+}
+
+// deliverLane claims and sends the jobs of a lane in order. A job that cannot
+// be claimed is being sent by another attempt and is skipped. An ordered lane
+// stops at the first job that is skipped or failed and waits for a retry.
+func (s *Scheduler) deliverLane(ctx context.Context, lane *deliveryLane, stats *runStats) {
+	for _, job := range lane.jobs {
+		if !s.acquireSend(ctx) {
+			return
+		}
+		claimed, err := s.outbox.Claim(job)
+		switch {
+		case err != nil:
+			logrus.Errorf("Failed to deliver outbox job %d: %v", job.ID, err)
+		case !claimed:
+			logrus.Debugf("Outbox job %d is claimed by another attempt, skipping", job.ID)
+		default:
+			err = s.deliverJob(ctx, job, stats)
+		}
+		s.releaseSend()
+
+		if claimed && errors.Is(err, service.ErrClaimLost) {
+			logrus.Warnf("Outbox job %d was claimed again while it was sent, its outcome is left to the other attempt", job.ID)
+		} else if claimed && err != nil {
+			logrus.Errorf("Failed to update outbox job %d: %v", job.ID, err)
+		}
+		if lane.ordered && (job.Status == model.OutboxStatusPending || job.Status == model.OutboxStatusProcessing) {
+			return
+		}
+	}
+}
+
+// deliverJob makes one attempt at sending a claimed outbox job and records the
+// outcome in the job itself together with the forward log, and in the run
+// statistics
+func (s *Scheduler) deliverJob(ctx context.Context, job *model.OutboxJob, stats *runStats) error {
+	if job.Rule == nil {
+		err := fmt.Errorf("rule %d no longer exists", job.RuleID)
+		logrus.Errorf("Failed to forward email %s: %v", job.MessageID, err)
+		stats.failed.Add(1)
+		stats.addError("Failed to forward email %s: %v", job.MessageID, err)
+		return s.markDead(job, err, service.NewForwardLog(job.AccountID, job.MessageID, &job.RuleID, "failure", err.Error()))
+	}
+
+	msg, err := service.DecodeJob(job)
+	if err != nil {
+		logrus.Errorf("Failed to forward email %s with rule %d: %v", job.MessageID, job.RuleID, err)
+		stats.failed.Add(1)
+		stats.addError("Failed to forward email %s with rule %d: %v", job.MessageID, job.RuleID, err)
+		return s.markDead(job, err, service.NewForwardLog(job.AccountID, job.MessageID, &job.RuleID, "failure", err.Error()))
+	}
+
+	rule, recipients := job.Rule, msg.Recipients
+	opts := service.ForwardOptions{
+		Mode:      rule.DeliveryMode,
+		Templates: service.RuleTemplates(rule),
+		Subject:   msg.Subject,
+		Rule:      rule,
+	}
+	err = s.forwarder.ForwardEmail(ctx, msg.Email, recipients, opts)
+	recipientLogs := newRecipientLogs(recipients, err)
+
+	var recipientErr *service.RecipientError
+	if err == nil || errors.As(err, &recipientErr) {
+		stats.forwarded.Add(1)
+	}
+
+	switch {
+	case err == nil:
+		s.metrics.ForwardSuccesses.Inc()
+		logrus.Infof("Forwarded email %s with rule %d to %s", job.MessageID, rule.ID, recipients)
+		return s.outbox.MarkSent(job, "", service.NewForwardLog(job.AccountID, job.MessageID, &rule.ID, "success", "", recipientLogs...))
+	case errors.As(err, &recipientErr):
+		// The message was delivered, so it is not retried for the
+		// rejected recipients
+		s.metrics.ForwardSuccesses.Inc()
+		logrus.Warnf("Forwarded email %s with rule %d, but %v", job.MessageID, rule.ID, err)
+		return s.outbox.MarkSent(job, err.Error(), service.NewForwardLog(job.AccountID, job.MessageID, &rule.ID, "partial", err.Error(), recipientLogs...))
+	}
+
+	s.metrics.ForwardFailures.Inc()
+	stats.failed.Add(1)
+	stats.addError("Failed to forward email %s with rule %d: %v", job.MessageID, rule.ID, err)
+
+	// Failures that cannot succeed on a retry go straight to the dead letters
+	if service.IsPermanent(err) {
+		logrus.Errorf("Failed to forward email %s with rule %d permanently, moved to dead letters: %v", job.MessageID, rule.ID, err)
+		return s.markDead(job, err, service.NewForwardLog(job.AccountID, job.MessageID, &rule.ID, "permanent_failure", err.Error(), recipientLogs...))
+	}
+
+	dead, updateErr := s.outbox.MarkFailed(job, err, service.NewForwardLog(job.AccountID, job.MessageID, &rule.ID, "failure", err.Error(), recipientLogs...))
+	if dead {
+		s.metrics.DeadLetters.Inc()
+		logrus.Errorf("Failed to forward email %s with rule %d after %d attempts, moved to dead letters: %v", job.MessageID, rule.ID, job.Attempts, err)
+	} else {
+		logrus.Warnf("Failed to forward email %s with rule %d (attempt %d), retrying at %s: %v", job.MessageID, rule.ID, job.Attempts, job.NextAttemptAt.Format(time.RFC3339), err)
+	}
+	return updateErr
+}
+
+// markDead moves a job to the dead letter state without further retries and
+// counts it in the dead letter metric
+func (s *Scheduler) markDead(job *model.OutboxJob, cause error, log *model.ForwardLog) error {
+	s.metrics.DeadLetters.Inc()
+	return s.outbox.MarkDead(job, cause, log)
+}
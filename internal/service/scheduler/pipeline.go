@@ -0,0 +1,378 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+
+	service "smart-mail-relay-go/internal/service"
+)
+
+// DefaultAccountName is the name of account 0, the mailbox configured in the
+// config file
+const DefaultAccountName = "default"
+
+// defaultSyncInterval is how often the mail accounts are reloaded when the
+// scheduler configuration leaves it unset
+const defaultSyncInterval = time.Minute
+
+// errFetcherClosed is returned when fetching account 0 after its fetcher was
+// closed
+var errFetcherClosed = errors.New("fetcher is closed")
+
+// pipeline fetches and processes the emails of one mail account. It has its
+// own cron entry, processing cycles and poller; the outbox is shared.
+type pipeline struct {
+	accountID uint
+	name      string
+	// spec is the cron spec of the account, or empty to follow the schedule
+	// of the scheduler
+	spec string
+	// updatedAt is when the account was last changed, to notice changes
+	// when the accounts are synced
+	updatedAt time.Time
+	entryID   cron.EntryID
+	lastRun   time.Time
+	poller    *Poller
+	// ctx is cancelled when the scheduler stops or the account is removed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// active is the processing cycle in progress, guarded by cycleMu
+	active *cycle
+
+	fetcherMu sync.Mutex
+	fetcher   service.EmailFetcher
+	// newFetcher connects the fetcher of the account; the connection is
+	// retried by the next cycles if it fails
+	newFetcher func() (service.EmailFetcher, error)
+}
+
+// AccountStatus describes the pipeline of a mail account
+type AccountStatus struct {
+	AccountID   uint         `json:"account_id"`
+	Name        string       `json:"name"`
+	Schedule    string       `json:"schedule"`
+	NextRun     time.Time    `json:"next_run"`
+	LastRun     time.Time    `json:"last_run"`
+	ActiveCycle *CycleInfo   `json:"active_cycle"`
+	Polling     PollingState `json:"polling"`
+}
+
+// newPipeline creates the pipeline of a mail account
+func (s *Scheduler) newPipeline(accountID uint, name, spec string, updatedAt time.Time, newFetcher func() (service.EmailFetcher, error)) *pipeline {
+	ctx, cancel := context.WithCancel(s.ctx)
+	return &pipeline{
+		accountID:  accountID,
+		name:       name,
+		spec:       spec,
+		updatedAt:  updatedAt,
+		poller:     NewPoller(s.config, name),
+		ctx:        ctx,
+		cancel:     cancel,
+		newFetcher: newFetcher,
+	}
+}
+
+// SyncAccounts reloads the mail accounts from the database. Pipelines are
+// started for new accounts, restarted for changed ones, and stopped for
+// accounts that were disabled or deleted; their cycles in progress finish
+// first. The pipeline replacing a changed one starts no cycle until the cycle
+// of the old one has ended.
+func (s *Scheduler) SyncAccounts() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncAccounts()
+}
+
+// syncPeriodically reloads the mail accounts and the schedule every
+// SyncInterval until ctx is cancelled, so that the changes made through
+// another replica apply here too
+func (s *Scheduler) syncPeriodically(ctx context.Context) {
+	defer s.wg.Done()
+
+	interval := s.config.SyncInterval
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sync()
+		}
+	}
+}
+
+// sync reloads the stored schedule and the mail accounts
+func (s *Scheduler) sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.syncSchedule(); err != nil {
+		logrus.Errorf("Failed to sync the schedule: %v", err)
+	}
+	if err := s.syncAccounts(); err != nil {
+		logrus.Errorf("Failed to sync mail accounts: %v", err)
+	}
+}
+
+// syncAccounts reloads the mail accounts. s.mu must be held.
+func (s *Scheduler) syncAccounts() error {
+	if s.accounts == nil {
+		return nil
+	}
+
+	accounts, err := s.accounts.Enabled()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[uint]bool, len(accounts))
+	for _, account := range accounts {
+		if p, ok := s.pipelines[account.ID]; ok && p.updatedAt.Equal(account.UpdatedAt) {
+			current[account.ID] = true
+		}
+	}
+
+	retired := make(map[uint]*pipeline)
+	for id, p := range s.pipelines {
+		if id != 0 && !current[id] {
+			s.retirePipeline(p)
+			delete(s.pipelines, id)
+			retired[id] = p
+		}
+	}
+
+	for i := range accounts {
+		account := accounts[i]
+		if current[account.ID] {
+			continue
+		}
+
+		p := s.newPipeline(account.ID, account.Name, account.Cron, account.UpdatedAt, func() (service.EmailFetcher, error) {
+			return s.accounts.NewFetcher(&account)
+		})
+		if old, ok := retired[account.ID]; ok {
+			s.handOverCycle(old, p)
+		}
+		s.pipelines[account.ID] = p
+		if s.isRunning {
+			s.startPipeline(p)
+		}
+		logrus.Infof("Started pipeline of mail account %s (%s)", account.Name, account.FetchMethod)
+	}
+	return nil
+}
+
+// startPipeline schedules the cycles of a pipeline and watches its mailbox
+// for new mail. A fetcher that is not connected yet is connected in the
+// background. s.mu must be held.
+func (s *Scheduler) startPipeline(p *pipeline) {
+	s.schedulePipeline(p)
+
+	p.fetcherMu.Lock()
+	fetcher := p.fetcher
+	p.fetcherMu.Unlock()
+
+	if fetcher != nil {
+		s.startWatcher(p, fetcher)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if _, err := s.pipelineFetcher(p); err != nil {
+			logrus.Errorf("Failed to connect mail account %s: %v", p.name, err)
+		}
+	}()
+}
+
+// retirePipeline stops a pipeline and closes its fetcher once its cycle in
+// progress has ended. s.mu must be held.
+func (s *Scheduler) retirePipeline(p *pipeline) {
+	p.cancel()
+	s.unschedulePipeline(p)
+	if s.metrics != nil {
+		s.metrics.FetchCircuitOpen.DeleteLabelValues(p.name)
+	}
+
+	s.cycleMu.Lock()
+	active := p.active
+	s.cycleMu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if active != nil {
+			<-active.done
+		}
+		if err := p.closeFetcher(); err != nil {
+			logrus.Errorf("Failed to close fetcher of %s: %v", p.name, err)
+		}
+	}()
+
+	logrus.Infof("Stopped pipeline of mail account %s", p.name)
+}
+
+// renewPipeline creates the pipeline taking over from one stopped with the
+// scheduler, deriving it from the current scheduler context. The fetcher,
+// poller and cycle in progress of the stopped pipeline are handed over. s.mu
+// must be held.
+func (s *Scheduler) renewPipeline(old *pipeline) *pipeline {
+	p := s.newPipeline(old.accountID, old.name, old.spec, old.updatedAt, old.newFetcher)
+	p.lastRun = old.lastRun
+	p.poller = old.poller
+
+	old.fetcherMu.Lock()
+	p.fetcher, old.fetcher = old.fetcher, nil
+	old.fetcherMu.Unlock()
+
+	s.handOverCycle(old, p)
+	return p
+}
+
+// handOverCycle makes the cycle in progress of a retired pipeline, if any,
+// the active cycle of the pipeline replacing it, so that the replacement
+// starts no cycle on the same mailbox until it has ended
+func (s *Scheduler) handOverCycle(old, p *pipeline) {
+	s.cycleMu.Lock()
+	defer s.cycleMu.Unlock()
+
+	if old.active != nil {
+		p.active = old.active
+		old.active.successor = p
+	}
+}
+
+// schedulePipeline adds the cron entry of a pipeline. An account with an
+// invalid schedule is left unscheduled. s.mu must be held.
+func (s *Scheduler) schedulePipeline(p *pipeline) {
+	spec := p.spec
+	if spec == "" {
+		spec = s.spec
+	}
+
+	schedule, err := parseSchedule(spec)
+	if err != nil {
+		logrus.Errorf("Not scheduling mail account %s: %v", p.name, err)
+		return
+	}
+	p.entryID = s.cron.Schedule(schedule, cron.FuncJob(func() { s.runScheduledCycle(p) }))
+}
+
+// unschedulePipeline removes the cron entry of a pipeline, keeping the time
+// of its last run. s.mu must be held.
+func (s *Scheduler) unschedulePipeline(p *pipeline) {
+	if prev := s.cron.Entry(p.entryID).Prev; !prev.IsZero() {
+		p.lastRun = prev
+	}
+	s.cron.Remove(p.entryID)
+	p.entryID = 0
+}
+
+// lastRun returns the time of the last scheduled run of a pipeline. s.mu must
+// be held.
+func (s *Scheduler) lastRun(p *pipeline) time.Time {
+	if prev := s.cron.Entry(p.entryID).Prev; !prev.IsZero() {
+		return prev
+	}
+	return p.lastRun
+}
+
+// pipelineFetcher returns the fetcher of a pipeline, connecting it first if
+// needed. A newly connected fetcher that supports push notifications is
+// watched for new mail.
+func (s *Scheduler) pipelineFetcher(p *pipeline) (service.EmailFetcher, error) {
+	p.fetcherMu.Lock()
+	defer p.fetcherMu.Unlock()
+
+	if p.fetcher != nil {
+		return p.fetcher, nil
+	}
+	if err := p.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if p.newFetcher == nil {
+		return nil, errFetcherClosed
+	}
+
+	fetcher, err := p.newFetcher()
+	if err != nil {
+		return nil, err
+	}
+	p.fetcher = fetcher
+
+	logrus.Infof("Connected mail account %s", p.name)
+	s.startWatcher(p, fetcher)
+	return fetcher, nil
+}
+
+// startWatcher watches the mailbox of a pipeline if its fetcher supports push
+// notifications
+func (s *Scheduler) startWatcher(p *pipeline, fetcher service.EmailFetcher) {
+	if watcher, ok := fetcher.(service.EmailWatcher); ok {
+		s.wg.Add(1)
+		go s.watch(p, watcher)
+	}
+}
+
+// closeFetcher closes the fetcher of a pipeline if it is connected
+func (p *pipeline) closeFetcher() error {
+	p.fetcherMu.Lock()
+	defer p.fetcherMu.Unlock()
+
+	if p.fetcher == nil {
+		return nil
+	}
+	err := p.fetcher.Close()
+	p.fetcher = nil
+	return err
+}
+
+// Accounts returns the state of the pipeline of every mail account, ordered
+// by account ID
+func (s *Scheduler) Accounts() []AccountStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]AccountStatus, 0, len(s.pipelines))
+	for _, p := range s.pipelines {
+		status := AccountStatus{
+			AccountID: p.accountID,
+			Name:      p.name,
+			Schedule:  p.spec,
+			Polling:   p.poller.State(),
+		}
+		if status.Schedule == "" {
+			status.Schedule = s.spec
+		}
+		if s.isRunning {
+			status.NextRun = s.cron.Entry(p.entryID).Next
+			status.LastRun = s.lastRun(p)
+		}
+
+		s.cycleMu.Lock()
+		if p.active != nil {
+			info := p.active.info
+			status.ActiveCycle = &info
+		}
+		s.cycleMu.Unlock()
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].AccountID < statuses[j].AccountID
+	})
+	return statuses
+}
@@ -0,0 +1,238 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"smart-mail-relay-go/config"
+)
+
+// Fetch circuit states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+const (
+	// defaultFetchBackoffBase, defaultFetchBackoffMax, defaultCircuitCooldown
+	// and defaultIdleMaxInterval apply when the scheduler configuration leaves
+	// them unset
+	defaultFetchBackoffBase = 30 * time.Second
+	defaultFetchBackoffMax  = 10 * time.Minute
+	defaultCircuitCooldown  = 15 * time.Minute
+	defaultIdleMaxInterval  = 30 * time.Minute
+	// pollSlack lets a cycle fetch slightly before its next fetch is due, as
+	// the cron tick it falls on may fire just ahead of it
+	pollSlack = time.Second
+)
+
+// PollingState describes the fetch backoff, circuit breaker and adaptive
+// polling of a mail account
+type PollingState struct {
+	Circuit             string     `json:"circuit"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	EmptyFetches        int        `json:"empty_fetches"`
+	LastFetch           *time.Time `json:"last_fetch"`
+	LastError           string     `json:"last_error,omitempty"`
+	// NextFetch is the earliest time a scheduled cycle fetches again, or nil
+	// if the next one does
+	NextFetch *time.Time `json:"next_fetch"`
+}
+
+// Poller decides whether a processing cycle fetches new emails. It backs off
+// exponentially on consecutive fetch failures and opens the circuit after
+// CircuitThreshold of them, and it fetches less often while no new mail
+// arrives.
+type Poller struct {
+	config  *config.SchedulerConfig
+	account string
+
+	mu        sync.Mutex
+	circuit   string
+	failures  int
+	empty     int
+	lastFetch time.Time
+	lastError string
+	// lastScheduled is when a scheduled cycle last fetched
+	lastScheduled time.Time
+	// notBefore is when fetching resumes after a failure or while idle
+	notBefore time.Time
+	// idleBase is the time between fetches when polling slowed down
+	idleBase time.Duration
+}
+
+// NewPoller creates a poller with a closed circuit for the mailbox of a mail
+// account
+func NewPoller(cfg *config.SchedulerConfig, account string) *Poller {
+	return &Poller{
+		config:  cfg,
+		account: account,
+		circuit: CircuitClosed,
+	}
+}
+
+// Allow reports whether a cycle started by trigger fetches at now, and
+// otherwise why not. Manual cycles always fetch, so they can probe the mailbox
+// while the circuit is open. Push cycles are not slowed down by idle polling,
+// as new mail has arrived.
+func (p *Poller) Allow(trigger string, now time.Time) (bool, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if trigger == TriggerManual || !now.Before(p.notBefore.Add(-pollSlack)) {
+		if p.circuit == CircuitOpen {
+			p.circuit = CircuitHalfOpen
+			logrus.Infof("Fetch circuit of %s half-open, probing the mailbox", p.account)
+		}
+		return true, ""
+	}
+
+	switch {
+	case p.circuit == CircuitOpen:
+		return false, fmt.Sprintf("fetch circuit is open until %s", p.notBefore.Format(time.RFC3339))
+	case p.failures > 0:
+		return false, fmt.Sprintf("backing off after %d failed fetches until %s", p.failures, p.notBefore.Format(time.RFC3339))
+	case trigger == TriggerPush:
+		return true, ""
+	}
+	return false, fmt.Sprintf("no new mail in the last %d fetches, next fetch at %s", p.empty, p.notBefore.Format(time.RFC3339))
+}
+
+// Record updates the state with the outcome of a fetch at now by a cycle
+// started by trigger, which returned count emails or failed with err. It
+// reports whether the circuit is open.
+func (p *Poller) Record(trigger string, now time.Time, count int, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastFetch = now
+	var prevScheduled time.Time
+	if trigger == TriggerSchedule {
+		prevScheduled = p.lastScheduled
+		p.lastScheduled = now
+	}
+
+	if err != nil {
+		p.failures++
+		p.lastError = err.Error()
+
+		threshold := p.config.CircuitThreshold
+		if p.circuit == CircuitHalfOpen || (threshold > 0 && p.failures >= threshold) {
+			p.circuit = CircuitOpen
+			p.notBefore = now.Add(p.circuitCooldown())
+			logrus.Warnf("Fetch circuit of %s open after %d consecutive failures, fetching again at %s", p.account, p.failures, p.notBefore.Format(time.RFC3339))
+		} else {
+			p.notBefore = now.Add(p.backoff())
+			logrus.Warnf("Fetching %s failed %d times in a row, fetching again at %s", p.account, p.failures, p.notBefore.Format(time.RFC3339))
+		}
+		return p.circuit == CircuitOpen
+	}
+
+	if p.circuit != CircuitClosed {
+		logrus.Infof("Fetch circuit of %s closed after %d consecutive failures", p.account, p.failures)
+	}
+	p.circuit = CircuitClosed
+	p.failures = 0
+	p.lastError = ""
+	p.notBefore = time.Time{}
+
+	if count > 0 {
+		if p.idleBase > 0 {
+			logrus.Infof("New mail arrived for %s, polling on schedule again", p.account)
+		}
+		p.empty = 0
+		p.idleBase = 0
+		return false
+	}
+
+	p.empty++
+	threshold := p.config.IdleThreshold
+	if threshold <= 0 || p.empty < threshold {
+		return false
+	}
+
+	// The time between the last two scheduled fetches before polling slowed
+	// down is the interval of the schedule, which doubles from there
+	if p.idleBase == 0 && !prevScheduled.IsZero() {
+		p.idleBase = now.Sub(prevScheduled)
+	}
+	if p.idleBase > 0 {
+		p.notBefore = now.Add(p.idleDelay())
+	}
+	return false
+}
+
+// State returns a snapshot of the polling state
+func (p *Poller) State() PollingState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := PollingState{
+		Circuit:             p.circuit,
+		ConsecutiveFailures: p.failures,
+		EmptyFetches:        p.empty,
+		LastError:           p.lastError,
+	}
+	if !p.lastFetch.IsZero() {
+		lastFetch := p.lastFetch
+		state.LastFetch = &lastFetch
+	}
+	if !p.notBefore.IsZero() {
+		notBefore := p.notBefore
+		state.NextFetch = &notBefore
+	}
+	return state
+}
+
+// backoff returns the delay after the current number of consecutive
+// failures: the base delay doubled for every failure after the first, capped
+// at the maximum delay
+func (p *Poller) backoff() time.Duration {
+	base, max := defaultFetchBackoffBase, defaultFetchBackoffMax
+	if p.config.FetchBackoffBase > 0 {
+		base = p.config.FetchBackoffBase
+	}
+	if p.config.FetchBackoffMax > 0 {
+		max = p.config.FetchBackoffMax
+	}
+	return doubled(base, p.failures-1, max)
+}
+
+// idleDelay returns the time until the next fetch while polling is slowed
+// down: twice the schedule interval once IdleThreshold fetches found no new
+// mail, doubling with every further one, capped at IdleMaxInterval
+func (p *Poller) idleDelay() time.Duration {
+	max := defaultIdleMaxInterval
+	if p.config.IdleMaxInterval > 0 {
+		max = p.config.IdleMaxInterval
+	}
+
+	delay := doubled(p.idleBase, p.empty-p.config.IdleThreshold+1, max)
+	if delay < p.idleBase {
+		return p.idleBase
+	}
+	return delay
+}
+
+// circuitCooldown returns how long the circuit stays open
+func (p *Poller) circuitCooldown() time.Duration {
+	if p.config.CircuitCooldown > 0 {
+		return p.config.CircuitCooldown
+	}
+	return defaultCircuitCooldown
+}
+
+// doubled returns d doubled n times, capped at max
+func doubled(d time.Duration, n int, max time.Duration) time.Duration {
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
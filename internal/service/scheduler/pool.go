@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+
+	"smart-mail-relay-go/config"
+)
+
+// workers returns the configured number of workers, at least one
+func workers(cfg *config.SchedulerConfig) int {
+	if cfg.Workers < 1 {
+		return 1
+	}
+	return cfg.Workers
+}
+
+// runWorkers calls fn for every index in [0, n) on up to the configured
+// number of goroutines and returns once all calls have finished
+func (s *Scheduler) runWorkers(n int, fn func(i int)) {
+	count := workers(s.config)
+	if count > n {
+		count = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// acquireSend waits for a free send slot. It returns false if ctx is
+// cancelled first.
+func (s *Scheduler) acquireSend(ctx context.Context) bool {
+	select {
+	case s.sends <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseSend frees a send slot taken by acquireSend
+func (s *Scheduler) releaseSend() {
+	<-s.sends
+}
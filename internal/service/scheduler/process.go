@@ -1,97 +1,252 @@
 package scheduler
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"smart-mail-relay-go/internal/model"
 	service "smart-mail-relay-go/internal/service"
 )
 
-// processEmails is the main processing function that runs periodically
-func (s *Scheduler) processEmails() {
+// processEmails is the main processing function of a cycle. Its progress is
+// counted in the cycle's run statistics.
+func (s *Scheduler) processEmails(c *cycle) {
 	s.wg.Add(1)
 	defer s.wg.Done()
 
-	logrus.Info("Starting email processing cycle")
+	logrus.Infof("Starting email processing cycle of %s", c.info.Account)
 
 	s.mu.RLock()
 	if !s.isRunning {
 		s.mu.RUnlock()
 		logrus.Info("Scheduler not running, skipping processing cycle")
+		c.stats.addError("Scheduler not running, skipping processing cycle")
 		return
 	}
 	s.mu.RUnlock()
 
+	stats := &c.stats
 	startTime := time.Now()
 
-	s.metrics.PullCount.Inc()
+	emails, fetcher := s.fetchEmails(c)
+
+	// Emails are parsed and matched concurrently, but queued in the order
+	// they were fetched so that ordered rules forward them in that order
+	var unrecorded atomic.Bool
+	emails = uniqueEmails(emails)
+	results := make([]matchResult, len(emails))
+	s.runWorkers(len(emails), func(i int) {
+		result, err := s.matchEmail(c.ctx, emails[i], stats)
+		if err != nil {
+			logrus.Errorf("Failed to process email %s: %v", emails[i].ID, err)
+			stats.addError("Failed to process email %s: %v", emails[i].ID, err)
+			unrecorded.Store(true)
+			return
+		}
+		results[i] = result
+	})
 
-	emails, err := s.fetcher.FetchNewEmails(s.ctx)
-	if err != nil {
-		logrus.Errorf("Failed to fetch emails: %v", err)
-		s.metrics.ForwardFailures.Inc()
-		return
+	for i, result := range results {
+		if !result.queue {
+			continue
+		}
+		if err := s.queueEmail(emails[i], result.matches); err != nil {
+			logrus.Errorf("Failed to process email %s: %v", emails[i].ID, err)
+			stats.addError("Failed to process email %s: %v", emails[i].ID, err)
+			unrecorded.Store(true)
+		}
 	}
 
-	logrus.Infof("Fetched %d new emails", len(emails))
-
-	for _, email := range emails {
-		if err := s.processEmail(email); err != nil {
-			logrus.Errorf("Failed to process email %s: %v", email.ID, err)
+	// The mailbox checkpoint only moves past the fetched emails once every
+	// one of them is queued or marked as processed; otherwise they are
+	// fetched again by the next cycle. A cancelled cycle leaves it to the
+	// cycle that takes over.
+	if fetcher != nil && !unrecorded.Load() && c.ctx.Err() == nil {
+		if err := fetcher.Commit(); err != nil {
+			logrus.Errorf("Failed to save mailbox checkpoint of %s: %v", c.info.Account, err)
+			stats.addError("Failed to save mailbox checkpoint: %v", err)
 		}
 	}
 
+	// Deliver the forwards queued above together with the retries that are
+	// due, even when fetching failed. The outbox is shared by all mail
+	// accounts; claims keep concurrent cycles from sending a job twice.
+	s.deliverOutbox(c.ctx, stats)
+
 	duration := time.Since(startTime)
-	logrus.Infof("Email processing cycle completed in %v", duration)
+	logrus.Infof("Email processing cycle of %s completed in %v", c.info.Account, duration)
+}
+
+// fetchEmails fetches new emails of the cycle's mail account unless its
+// poller holds fetching back after failures or while no new mail arrives. A
+// fetcher that could not connect yet is connected first; failing to connect
+// counts as a failed fetch. The fetcher is returned with the emails to commit
+// its checkpoint, or nil if nothing was fetched.
+func (s *Scheduler) fetchEmails(c *cycle) ([]service.EmailMessage, service.EmailFetcher) {
+	p := c.pipeline
+	stats := &c.stats
+	now := time.Now()
+
+	if ok, reason := p.poller.Allow(c.info.Trigger, now); !ok {
+		logrus.Infof("Skipping fetch of %s: %s", p.name, reason)
+		return nil, nil
+	}
+
+	s.metrics.PullCount.Inc()
+
+	var emails []service.EmailMessage
+	fetcher, err := s.pipelineFetcher(p)
+	if err == nil {
+		emails, err = fetcher.FetchNewEmails(c.ctx)
+	}
+
+	// A fetch cancelled by stopping the scheduler, removing the account or
+	// losing the leadership says nothing about the mailbox
+	if c.ctx.Err() == nil {
+		if p.poller.Record(c.info.Trigger, now, len(emails), err) {
+			s.metrics.FetchCircuitOpen.WithLabelValues(p.name).Set(1)
+		} else {
+			s.metrics.FetchCircuitOpen.WithLabelValues(p.name).Set(0)
+		}
+	}
+
+	if err != nil {
+		logrus.Errorf("Failed to fetch emails of %s: %v", p.name, err)
+		s.metrics.FetchFailures.Inc()
+		stats.fetchFailed.Store(true)
+		stats.addError("Failed to fetch emails: %v", err)
+		return nil, nil
+	}
+
+	for i := range emails {
+		emails[i].AccountID = p.accountID
+	}
+
+	logrus.Infof("Fetched %d new emails of %s", len(emails), p.name)
+	stats.fetched.Add(int64(len(emails)))
+	return emails, fetcher
+}
+
+// matchResult holds the rules a fetched email is to be queued for
+type matchResult struct {
+	matches []service.RuleMatch
+	// queue is false for emails that were already processed or matched no
+	// rule; an email whose rules all forwarded it already is still queued
+	// so that it is marked as processed
+	queue bool
 }
 
-// processEmail processes a single email
-func (s *Scheduler) processEmail(email service.EmailMessage) error {
+// matchEmail checks whether a single email still has to be processed and
+// finds the rules it has to be forwarded with
+func (s *Scheduler) matchEmail(ctx context.Context, email service.EmailMessage, stats *runStats) (matchResult, error) {
 	select {
-	case <-s.ctx.Done():
-		return fmt.Errorf("context cancelled")
+	case <-ctx.Done():
+		return matchResult{}, fmt.Errorf("context cancelled")
 	default:
 	}
 
-	processed, err := s.parser.IsEmailProcessed(email.ID)
+	processed, err := s.parser.IsEmailProcessed(email.AccountID, email.ID)
 	if err != nil {
-		return fmt.Errorf("failed to check if email is processed: %w", err)
+		return matchResult{}, fmt.Errorf("failed to check if email is processed: %w", err)
 	}
 
 	if processed {
 		logrus.Debugf("Email %s already processed, skipping", email.ID)
-		return nil
+		return matchResult{}, nil
 	}
 
-	rule, err := s.parser.ParseAndMatchEmail(email)
+	matches, err := s.parser.ParseAndMatchRules(email)
 	if err != nil {
-		s.parser.LogForwardAttempt(email.ID, nil, "error", err.Error())
-		return fmt.Errorf("failed to parse and match email: %w", err)
+		s.parser.LogForwardAttempt(email.AccountID, email.ID, nil, "error", err.Error())
+		return matchResult{}, fmt.Errorf("failed to parse and match email: %w", err)
 	}
 
-	if rule == nil {
-		s.parser.LogForwardAttempt(email.ID, nil, "skipped", "No matching rule found")
-		s.parser.MarkEmailAsProcessed(email.ID)
-		return nil
+	if len(matches) == 0 {
+		s.parser.LogForwardAttempt(email.AccountID, email.ID, nil, "skipped", "No matching rule found")
+		if err := s.parser.MarkEmailAsProcessed(email.AccountID, email.ID); err != nil {
+			return matchResult{}, err
+		}
+		return matchResult{}, nil
 	}
 
 	s.metrics.MatchCount.Inc()
+	stats.matched.Add(1)
 
-	err = s.forwarder.ForwardEmail(s.ctx, email, rule.TargetEmail)
+	// Rules that already forwarded the email are not queued again
+	forwarded, err := s.parser.GetForwardedRuleIDs(email.AccountID, email.ID)
 	if err != nil {
-		s.parser.LogForwardAttempt(email.ID, &rule.ID, "failure", err.Error())
-		s.metrics.ForwardFailures.Inc()
-		return fmt.Errorf("failed to forward email: %w", err)
+		return matchResult{}, err
 	}
 
-	if err := s.parser.MarkEmailAsProcessed(email.ID); err != nil {
-		logrus.Errorf("Failed to mark email as processed: %v", err)
+	var pending []service.RuleMatch
+	for _, match := range matches {
+		if forwarded[match.Rule.ID] {
+			logrus.Debugf("Email %s already forwarded with rule %d, skipping", email.ID, match.Rule.ID)
+			continue
+		}
+		pending = append(pending, match)
 	}
 
-	s.parser.LogForwardAttempt(email.ID, &rule.ID, "success", "")
-	s.metrics.ForwardSuccesses.Inc()
+	return matchResult{matches: pending, queue: true}, nil
+}
+
+// queueEmail adds the forwards of an email to the outbox. The email is marked
+// as processed in the same transaction; its forwards are delivered and
+// retried from the outbox.
+func (s *Scheduler) queueEmail(email service.EmailMessage, matches []service.RuleMatch) error {
+	if _, err := s.outbox.Enqueue(email, matches); err != nil {
+		return err
+	}
 
-	logrus.Infof("Successfully processed email %s with rule %s", email.ID, rule.Keyword)
+	logrus.Infof("Queued email %s for forwarding with %d rules", email.ID, len(matches))
 	return nil
 }
+
+// uniqueEmails drops repeated message IDs, keeping the first occurrence, so
+// the concurrent workers never process the same email twice
+func uniqueEmails(emails []service.EmailMessage) []service.EmailMessage {
+	seen := make(map[string]bool, len(emails))
+	unique := emails[:0]
+	for _, email := range emails {
+		if seen[email.ID] {
+			continue
+		}
+		seen[email.ID] = true
+		unique = append(unique, email)
+	}
+	return unique
+}
+
+// newRecipientLogs returns the per-recipient log entries of a forwarding
+// attempt. Every recipient shares the outcome of err unless it is a
+// *service.RecipientError, which only fails the rejected addresses.
+func newRecipientLogs(recipients service.Recipients, err error) []model.ForwardLogRecipient {
+	var recipientErr *service.RecipientError
+	errors.As(err, &recipientErr)
+
+	var logs []model.ForwardLogRecipient
+	add := func(emails []string, role string) {
+		for _, email := range emails {
+			entry := model.ForwardLogRecipient{Email: email, Role: role, Status: "success"}
+			if recipientErr != nil {
+				if rejectErr, ok := recipientErr.Rejected[email]; ok {
+					entry.Status = "failure"
+					entry.ErrorMsg = rejectErr.Error()
+				}
+			} else if err != nil {
+				entry.Status = "failure"
+				entry.ErrorMsg = err.Error()
+			}
+			logs = append(logs, entry)
+		}
+	}
+
+	add(recipients.To, model.RecipientRoleTo)
+	add(recipients.Cc, model.RecipientRoleCc)
+	add(recipients.Bcc, model.RecipientRoleBcc)
+	return logs
+}
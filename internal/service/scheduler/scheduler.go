@@ -2,8 +2,10 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -14,39 +16,88 @@ import (
 	service "smart-mail-relay-go/internal/service"
 )
 
-// Scheduler manages the periodic email processing
+// cronParser parses processing schedules: cron specs with an optional
+// seconds field, and descriptors such as "@hourly" or "@every 30s"
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// scheduleSetting is the stored setting holding the schedule set through
+// Reschedule
+const scheduleSetting = "schedule"
+
+// ErrInvalidSchedule is returned for a schedule that is not a valid cron spec
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// Scheduler manages the periodic email processing. Every mail account is
+// fetched by its own pipeline, with its own schedule, cycles and fetch
+// backoff, so that a failing mailbox does not hold back the others.
 type Scheduler struct {
 	cron      *cron.Cron
-	entryID   cron.EntryID
+	spec      string
 	config    *config.SchedulerConfig
-	fetcher   service.EmailFetcher
+	pipelines map[uint]*pipeline
+	accounts  *service.AccountStore
 	parser    *service.EmailParser
-	forwarder *service.EmailForwarder
+	forwarder service.EmailForwarder
+	outbox    *service.Outbox
+	runs      *service.RunHistory
+	elector   *service.LeaderElector
+	settings  *service.SettingStore
+	leader    atomic.Bool
 	metrics   *metricsPkg.Metrics
-	ctx       context.Context
-	cancel    context.CancelFunc
-	wg        sync.WaitGroup
-	isRunning bool
-	mu        sync.RWMutex
+	sends     chan struct{}
+	// ctx is cancelled when the scheduler stops; Start creates a new one
+	// when the scheduler is started again
+	ctx    context.Context
+	cancel context.CancelFunc
+	// campaignDone is closed once the leader election of the last start
+	// has released the lease
+	campaignDone chan struct{}
+	wg           sync.WaitGroup
+	isRunning    bool
+	mu           sync.RWMutex
+	cycleMu      sync.Mutex
 }
 
-// New creates a new scheduler
-func New(cfg *config.SchedulerConfig, fetcher service.EmailFetcher, parser *service.EmailParser, forwarder *service.EmailForwarder, metrics *metricsPkg.Metrics) *Scheduler {
+// New creates a new scheduler. fetcher fetches the mailbox configured in the
+// config file as account 0; the mail accounts of the account store are loaded
+// when the scheduler starts. A schedule stored in settings replaces the one
+// of the config file.
+func New(cfg *config.SchedulerConfig, fetcher service.EmailFetcher, accounts *service.AccountStore, parser *service.EmailParser, forwarder service.EmailForwarder, outbox *service.Outbox, runs *service.RunHistory, elector *service.LeaderElector, settings *service.SettingStore, metrics *metricsPkg.Metrics) *Scheduler {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Scheduler{
-		cron:      cron.New(cron.WithSeconds()),
+	maxSends := cfg.MaxInFlightSends
+	if maxSends <= 0 {
+		maxSends = workers(cfg)
+	}
+
+	s := &Scheduler{
+		cron:      cron.New(cron.WithParser(cronParser)),
+		spec:      cfg.Schedule(),
 		config:    cfg,
-		fetcher:   fetcher,
+		pipelines: make(map[uint]*pipeline),
+		accounts:  accounts,
 		parser:    parser,
 		forwarder: forwarder,
+		outbox:    outbox,
+		runs:      runs,
+		elector:   elector,
+		settings:  settings,
 		metrics:   metrics,
+		sends:     make(chan struct{}, maxSends),
 		ctx:       ctx,
 		cancel:    cancel,
 	}
+
+	if fetcher != nil {
+		p := s.newPipeline(0, DefaultAccountName, "", time.Time{}, nil)
+		p.fetcher = fetcher
+		s.pipelines[0] = p
+	}
+	return s
 }
 
-// Start starts the scheduler
+// Start starts the scheduler. A mail account that cannot be loaded or
+// connected does not keep the others from starting.
 func (s *Scheduler) Start() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -55,28 +106,148 @@ func (s *Scheduler) Start() error {
 		return fmt.Errorf("scheduler is already running")
 	}
 
-	schedule := fmt.Sprintf("0 */%d * * * *", s.config.IntervalMinutes)
+	if err := s.syncSchedule(); err != nil {
+		logrus.Errorf("Failed to load the stored schedule: %v", err)
+	}
+	if _, err := parseSchedule(s.spec); err != nil {
+		return err
+	}
 
-	entryID, err := s.cron.AddFunc(schedule, s.processEmails)
-	if err != nil {
-		return fmt.Errorf("failed to add cron job: %w", err)
+	// A stopped scheduler is started again with a new context, and
+	// pipelines that take over from the stopped ones
+	if s.ctx.Err() != nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		for id, p := range s.pipelines {
+			s.pipelines[id] = s.renewPipeline(p)
+		}
 	}
 
-	s.entryID = entryID
-	s.cron.Start()
+	for _, p := range s.pipelines {
+		s.startPipeline(p)
+	}
 	s.isRunning = true
 
-	logrus.Infof("Scheduler started with interval: %d minutes", s.config.IntervalMinutes)
+	if err := s.syncAccounts(); err != nil {
+		logrus.Errorf("Failed to load mail accounts: %v", err)
+	}
+
+	s.cron.Start()
+
+	if s.accounts != nil || s.settings != nil {
+		s.wg.Add(1)
+		go s.syncPeriodically(s.ctx)
+	}
+
+	if s.elector != nil {
+		s.campaignDone = make(chan struct{})
+		s.wg.Add(1)
+		go s.campaign(s.ctx, s.campaignDone)
+	}
+
+	logrus.Infof("Scheduler started with schedule %s for %d mail accounts", s.spec, len(s.pipelines))
+	return nil
+}
+
+// Reschedule replaces the schedule of the processing cycles without
+// restarting the scheduler. Mail accounts with a schedule of their own keep
+// it. A cycle in progress is not interrupted. The schedule is stored, so the
+// other replicas apply it when they next sync, and it outlasts restarts.
+func (s *Scheduler) Reschedule(spec string) error {
+	if _, err := parseSchedule(spec); err != nil {
+		return err
+	}
+
+	if s.settings != nil {
+		if err := s.settings.Set(scheduleSetting, spec); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applySchedule(spec)
+	return nil
+}
+
+// syncSchedule applies the schedule stored by Reschedule, on this or another
+// replica. s.mu must be held.
+func (s *Scheduler) syncSchedule() error {
+	if s.settings == nil {
+		return nil
+	}
+
+	spec, ok, err := s.settings.Get(scheduleSetting)
+	if err != nil || !ok {
+		return err
+	}
+	if _, err := parseSchedule(spec); err != nil {
+		return err
+	}
+	s.applySchedule(spec)
 	return nil
 }
 
-// Stop stops the scheduler
+// applySchedule replaces the schedule of the pipelines without one of their
+// own. s.mu must be held.
+func (s *Scheduler) applySchedule(spec string) {
+	if spec == s.spec {
+		return
+	}
+
+	logrus.Infof("Scheduler rescheduled from %s to %s", s.spec, spec)
+	s.spec = spec
+
+	if s.isRunning {
+		for _, p := range s.pipelines {
+			if p.spec != "" {
+				continue
+			}
+			s.unschedulePipeline(p)
+			s.schedulePipeline(p)
+		}
+	}
+}
+
+// Schedule returns the cron spec of the processing cycles
+func (s *Scheduler) Schedule() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.spec
+}
+
+// ValidateSchedule checks that spec is a valid cron spec
+func ValidateSchedule(spec string) error {
+	_, err := parseSchedule(spec)
+	return err
+}
+
+// parseSchedule parses a cron spec
+func parseSchedule(spec string) (cron.Schedule, error) {
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrInvalidSchedule, spec, err)
+	}
+	return schedule, nil
+}
+
+// Stop stops the scheduler. With leader election, it returns once the lease
+// has been released, so that starting the scheduler again campaigns afresh.
 func (s *Scheduler) Stop() error {
+	campaignDone, err := s.stop()
+	if campaignDone != nil {
+		<-campaignDone
+	}
+	return err
+}
+
+// stop stops the cron entries and pipelines and returns the channel closed
+// when the leader election has ended, if it runs
+func (s *Scheduler) stop() (chan struct{}, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if !s.isRunning {
-		return nil
+		return nil, nil
 	}
 
 	s.cancel()
@@ -90,8 +261,12 @@ func (s *Scheduler) Stop() error {
 		logrus.Warn("Scheduler stop timeout, forcing shutdown")
 	}
 
+	for _, p := range s.pipelines {
+		s.unschedulePipeline(p)
+	}
+
 	s.isRunning = false
-	return nil
+	return s.campaignDone, nil
 }
 
 // IsRunning returns whether the scheduler is running
@@ -101,34 +276,99 @@ func (s *Scheduler) IsRunning() bool {
 	return s.isRunning
 }
 
-// RunOnce runs the email processing once (for manual triggering)
-func (s *Scheduler) RunOnce() error {
-	logrus.Info("Running email processing once")
-	s.processEmails()
-	return nil
+// RunOnce starts a processing cycle of a mail account in the background (for
+// manual triggering) and returns its run ID. If a cycle of the account is
+// already in progress, RunOnce returns the ID of that run and reports that it
+// joined it when join is set, and returns ErrCycleActive otherwise.
+func (s *Scheduler) RunOnce(accountID uint, join bool) (runID uint, joined bool, err error) {
+	s.mu.RLock()
+	running, p := s.isRunning, s.pipelines[accountID]
+	s.mu.RUnlock()
+
+	if !running {
+		return 0, false, ErrNotRunning
+	}
+	if p == nil {
+		return 0, false, ErrUnknownAccount
+	}
+
+	c, started, err := s.beginCycle(p, TriggerManual)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !started {
+		if !join {
+			return 0, false, ErrCycleActive
+		}
+		logrus.Infof("Joining the %s processing cycle of %s in progress (run %d)", c.info.Trigger, p.name, c.info.RunID)
+		return c.info.RunID, true, nil
+	}
+
+	logrus.Infof("Running email processing of %s once (run %d)", p.name, c.info.RunID)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.endCycle(c)
+		s.processEmails(c)
+	}()
+
+	return c.info.RunID, false, nil
 }
 
-// GetNextRun returns the time of the next scheduled run
+// GetNextRun returns the time of the next scheduled run of any mail account
 func (s *Scheduler) GetNextRun() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if !s.isRunning {
 		return time.Time{}
 	}
 
-	entry := s.cron.Entry(s.entryID)
-	return entry.Next
+	var next time.Time
+	for _, p := range s.pipelines {
+		if n := s.cron.Entry(p.entryID).Next; !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
 }
 
-// GetLastRun returns the time of the last run
+// GetLastRun returns the time of the last scheduled run of any mail account,
+// including runs under a previous schedule
 func (s *Scheduler) GetLastRun() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if !s.isRunning {
 		return time.Time{}
 	}
 
-	entry := s.cron.Entry(s.entryID)
-	return entry.Prev
+	var last time.Time
+	for _, p := range s.pipelines {
+		if l := s.lastRun(p); l.After(last) {
+			last = l
+		}
+	}
+	return last
 }
 
 // Wait waits for the scheduler to stop
 func (s *Scheduler) Wait() {
 	s.wg.Wait()
 }
+
+// Close closes the fetchers of the mail accounts
+func (s *Scheduler) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, p := range s.pipelines {
+		if err := p.closeFetcher(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close fetcher of %s: %w", p.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+	service "smart-mail-relay-go/internal/service"
+)
+
+// watch runs a processing cycle of a pipeline whenever its fetcher pushes a
+// new-mail notification. Notifications arriving while a cycle is in progress
+// are coalesced into a single follow-up cycle, which starts once the active
+// one has finished. The cron schedule keeps polling regardless, so mail is
+// still picked up if push delivery stops.
+func (s *Scheduler) watch(p *pipeline, w service.EmailWatcher) {
+	defer s.wg.Done()
+
+	trigger := make(chan struct{}, 1)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- w.Watch(p.ctx, func() {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		})
+	}()
+
+	for {
+		select {
+		case <-trigger:
+			logrus.Infof("New email notification received for %s", p.name)
+			s.runPushCycle(p)
+		case err := <-done:
+			if errors.Is(err, service.ErrPushUnavailable) {
+				logrus.Infof("Push notifications unavailable for %s, relying on scheduled polling", p.name)
+			} else if err != nil {
+				logrus.Errorf("Email watcher of %s stopped: %v", p.name, err)
+			}
+			return
+		}
+	}
+}
+
+// runPushCycle runs a processing cycle of a pipeline for a push
+// notification. The mail may have arrived after an active cycle fetched, so it
+// waits for that cycle to end and runs its own.
+func (s *Scheduler) runPushCycle(p *pipeline) {
+	for {
+		active, ran, err := s.runCycle(p, TriggerPush)
+		if errors.Is(err, ErrNotLeader) {
+			logrus.Debug("Ignoring new email notification, this instance is not the leader")
+			return
+		}
+		if errors.Is(err, ErrNotRunning) {
+			return
+		}
+		if err != nil {
+			logrus.Errorf("Failed to start processing cycle: %v", err)
+			return
+		}
+		if ran {
+			return
+		}
+
+		select {
+		case <-active.done:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// SettingStore persists the scheduler settings shared by all replicas
+type SettingStore struct {
+	db *gorm.DB
+}
+
+// NewSettingStore creates a new setting store
+func NewSettingStore(db *gorm.DB) *SettingStore {
+	return &SettingStore{db: db}
+}
+
+// Get returns the value of a setting. ok is false if it has never been set.
+func (s *SettingStore) Get(name string) (value string, ok bool, err error) {
+	var setting model.SchedulerSetting
+	result := s.db.Where("name = ?", name).First(&setting)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to get setting %s: %w", name, result.Error)
+	}
+	return setting.Value, true, nil
+}
+
+// Set stores the value of a setting
+func (s *SettingStore) Set(name, value string) error {
+	setting := model.SchedulerSetting{Name: name, Value: value}
+	result := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&setting)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save setting %s: %w", name, result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"smart-mail-relay-go/config"
+)
+
+// Supported SMTP TLS modes
+const (
+	SMTPTLSStartTLS = "starttls"
+	SMTPTLSImplicit = "tls"
+	SMTPTLSNone     = "none"
+)
+
+// Supported SMTP authentication mechanisms
+const (
+	SMTPAuthPlain   = "plain"
+	SMTPAuthLogin   = "login"
+	SMTPAuthXOAuth2 = "xoauth2"
+	SMTPAuthNone    = "none"
+)
+
+// smtpDialTimeout bounds establishing the SMTP connection
+const smtpDialTimeout = 30 * time.Second
+
+// SMTPForwarder implements EmailForwarder using an SMTP relay
+type SMTPForwarder struct {
+	config      *config.SMTPConfig
+	tokenSource oauth2.TokenSource
+}
+
+// NewSMTPForwarder creates a new SMTP forwarder
+func NewSMTPForwarder(cfg *config.SMTPConfig) (*SMTPForwarder, error) {
+	switch cfg.TLSMode {
+	case SMTPTLSStartTLS, SMTPTLSImplicit, SMTPTLSNone:
+	default:
+		return nil, fmt.Errorf("unsupported SMTP TLS mode: %q", cfg.TLSMode)
+	}
+
+	forwarder := &SMTPForwarder{
+		config: cfg,
+	}
+
+	switch cfg.Auth {
+	case SMTPAuthPlain, SMTPAuthLogin, SMTPAuthNone:
+	case SMTPAuthXOAuth2:
+		endpoint := google.Endpoint
+		if cfg.TokenURL != "" {
+			endpoint = oauth2.Endpoint{TokenURL: cfg.TokenURL}
+		}
+
+		oauth2Config := &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     endpoint,
+		}
+
+		forwarder.tokenSource = oauth2Config.TokenSource(context.Background(), &oauth2.Token{
+			RefreshToken: cfg.RefreshToken,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported SMTP auth mechanism: %q", cfg.Auth)
+	}
+
+	return forwarder, nil
+}
+
+// ForwardEmail forwards an email to the recipients in a single SMTP
+// transaction
+func (f *SMTPForwarder) ForwardEmail(ctx context.Context, originalEmail EmailMessage, recipients Recipients, opts ForwardOptions) error {
+	// Building the message again gives the same result
+	forwardedEmail, err := BuildForwardMessage(f.config.From, originalEmail, recipients, opts)
+	if err != nil {
+		return &PermanentError{Err: fmt.Errorf("failed to create forwarded email: %w", err)}
+	}
+
+	if err := f.send(ctx, recipients.All(), []byte(forwardedEmail)); err != nil {
+		var recipientErr *RecipientError
+		if errors.As(err, &recipientErr) {
+			logrus.Warnf("Forwarded email %s via SMTP with rejected recipients: %v", originalEmail.ID, err)
+			return err
+		}
+		return fmt.Errorf("failed to forward email via SMTP: %w", err)
+	}
+
+	logrus.Infof("Successfully forwarded email %s to %s via SMTP", originalEmail.ID, recipients)
+	return nil
+}
+
+// send delivers a message to the given recipients in a single SMTP session.
+// Recipients rejected at RCPT TO are skipped and reported in a
+// *RecipientError once the message has been accepted for the others.
+func (f *SMTPForwarder) send(ctx context.Context, recipients []string, msg []byte) error {
+	c, err := f.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Abort the session if ctx is cancelled mid-transfer
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+	defer stop()
+
+	if err := f.authenticate(c); err != nil {
+		return err
+	}
+
+	if err := c.Mail(f.config.From); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+
+	rejected := make(map[string]error)
+	for _, recipient := range recipients {
+		if err := c.Rcpt(recipient); err != nil {
+			// Connection errors are not recipient rejections
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			rejected[recipient] = err
+		}
+	}
+
+	if len(rejected) == len(recipients) {
+		return fmt.Errorf("all %v", &RecipientError{Rejected: rejected})
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %w", err)
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to finish message: %w", err)
+	}
+
+	// The message has been accepted at this point, so a failed QUIT must not
+	// cause it to be sent again
+	if err := c.Quit(); err != nil {
+		logrus.Debugf("SMTP QUIT failed: %v", err)
+	}
+
+	if len(rejected) > 0 {
+		return &RecipientError{Rejected: rejected}
+	}
+	return nil
+}
+
+// dial connects to the SMTP server and negotiates TLS according to the
+// configured mode
+func (f *SMTPForwarder) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(f.config.Host, strconv.Itoa(f.config.Port))
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	tlsConfig := &tls.Config{ServerName: f.config.Host}
+
+	var conn net.Conn
+	var err error
+	if f.config.TLSMode == SMTPTLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, f.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create SMTP client: %w", err)
+	}
+
+	if f.config.TLSMode == SMTPTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// authenticate runs the configured SMTP AUTH mechanism
+func (f *SMTPForwarder) authenticate(c *smtp.Client) error {
+	var auth smtp.Auth
+
+	switch f.config.Auth {
+	case SMTPAuthNone:
+		return nil
+	case SMTPAuthPlain:
+		auth = smtp.PlainAuth("", f.config.Username, f.config.Password, f.config.Host)
+	case SMTPAuthLogin:
+		auth = &loginAuth{username: f.config.Username, password: f.config.Password}
+	case SMTPAuthXOAuth2:
+		token, err := f.tokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("failed to get OAuth2 token: %w", err)
+		}
+		auth = &xoauth2Auth{username: f.config.Username, token: token.AccessToken}
+	}
+
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("SMTP server does not support AUTH")
+	}
+
+	if err := c.Auth(auth); err != nil {
+		return fmt.Errorf("SMTP authentication failed: %w", err)
+	}
+	return nil
+}
+
+// Close closes the forwarder (connections are opened per message)
+func (f *SMTPForwarder) Close() error {
+	return nil
+}
+
+// loginAuth implements the LOGIN SASL mechanism
+type loginAuth struct {
+	username string
+	password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("refusing LOGIN authentication over an unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 SASL mechanism
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("refusing XOAUTH2 authentication over an unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sent an error challenge; an empty response makes it
+		// finish the exchange with the actual failure
+		return []byte{}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"smart-mail-relay-go/config"
+)
+
+// defaultSubjectPatterns are tried when no subject patterns are configured:
+// a leading bracket tag such as "[SALES] ...", then "<keyword> - <recipient>"
+// with an ASCII, en, em or full-width dash. After a bracket tag, the recipient
+// is only taken from text introduced by a dash or "to:", so the rest of an
+// ordinary subject is not looked up as a contact name.
+var defaultSubjectPatterns = []string{
+	`^\[(?P<keyword>[^\]]+)\]\s*(?:(?:[-–—－]|(?i:to)\s*[:：])\s*(?P<recipient>.+))?`,
+	`^(?P<keyword>[^-–—－]+?)\s*[-–—－]\s*(?P<recipient>.+)$`,
+}
+
+// defaultStripPrefixes are the reply and forward prefixes removed when none
+// are configured (English, German and Chinese mail clients)
+var defaultStripPrefixes = []string{"Re", "Fwd", "Fw", "AW", "WG", "回复", "答复", "转发"}
+
+// SubjectParts holds the fields extracted from an email subject
+type SubjectParts struct {
+	Keyword   string
+	Recipient string
+}
+
+// subjectGrammar extracts keywords and recipient names from subjects
+type subjectGrammar struct {
+	prefixes *regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+// newSubjectGrammar compiles the subject patterns and strip prefixes of cfg,
+// falling back to the defaults for empty lists
+func newSubjectGrammar(cfg *config.ParserConfig) (*subjectGrammar, error) {
+	patterns := defaultSubjectPatterns
+	prefixes := defaultStripPrefixes
+	if cfg != nil {
+		if len(cfg.SubjectPatterns) > 0 {
+			patterns = cfg.SubjectPatterns
+		}
+		if len(cfg.StripPrefixes) > 0 {
+			prefixes = cfg.StripPrefixes
+		}
+	}
+
+	grammar := &subjectGrammar{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject pattern %q: %w", pattern, err)
+		}
+		grammar.patterns = append(grammar.patterns, re)
+	}
+
+	quoted := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			quoted = append(quoted, regexp.QuoteMeta(prefix))
+		}
+	}
+	if len(quoted) > 0 {
+		// Repeated prefixes with an optional counter, e.g. "Re[2]: Fwd: "
+		grammar.prefixes = regexp.MustCompile(`(?i)^(?:(?:` + strings.Join(quoted, "|") + `)\s*(?:\[\d+\]|\(\d+\))?\s*[:：]\s*)+`)
+	}
+
+	return grammar, nil
+}
+
+// parse strips reply/forward prefixes and extracts the keyword and recipient
+// name with the first matching pattern. If no pattern matches, the first word
+// of the subject is used as the keyword.
+func (g *subjectGrammar) parse(subject string) SubjectParts {
+	subject = strings.TrimSpace(subject)
+	if g.prefixes != nil {
+		subject = g.prefixes.ReplaceAllString(subject, "")
+	}
+
+	if subject == "" {
+		return SubjectParts{}
+	}
+
+	for _, re := range g.patterns {
+		matches := re.FindStringSubmatch(subject)
+		if matches == nil {
+			continue
+		}
+
+		var parts SubjectParts
+		if i := re.SubexpIndex("keyword"); i >= 0 {
+			parts.Keyword = matches[i]
+		} else if len(matches) > 1 {
+			parts.Keyword = matches[1]
+		} else {
+			parts.Keyword = matches[0]
+		}
+		if i := re.SubexpIndex("recipient"); i >= 0 {
+			parts.Recipient = matches[i]
+		}
+
+		parts.Keyword = strings.TrimSpace(parts.Keyword)
+		parts.Recipient = strings.TrimSpace(parts.Recipient)
+		if parts.Keyword != "" {
+			return parts
+		}
+	}
+
+	// If no pattern matches, try to extract just the first word as keyword
+	words := strings.Fields(subject)
+	if len(words) > 0 {
+		return SubjectParts{Keyword: words[0]}
+	}
+	return SubjectParts{}
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+
+	"smart-mail-relay-go/internal/model"
+)
+
+// ForwardTemplates are the per-rule templates of a forwarded email. Empty
+// templates use the defaults: a "Fwd: " subject, the "Forwarded message"
+// header block and no footer.
+type ForwardTemplates struct {
+	Subject string
+	Header  string
+	Footer  string
+}
+
+// TemplateData is the data available to forwarding templates
+type TemplateData struct {
+	Subject   string
+	From      string
+	To        []string
+	Cc        []string
+	Date      string
+	MessageID string
+	Headers   map[string]string
+	Body      string
+	Keyword   string
+	Recipient string
+	Rule      model.ForwardRule
+}
+
+// ForwardPreview is a forwarded email rendered for preview
+type ForwardPreview struct {
+	Subject  string `json:"subject"`
+	TextBody string `json:"text_body"`
+	HTMLBody string `json:"html_body,omitempty"`
+}
+
+// forwardText holds the rendered subject, header block and footer of a
+// forwarded email
+type forwardText struct {
+	subject    string
+	headerText string
+	headerHTML string
+	footerText string
+	footerHTML string
+}
+
+// templateFuncs are the functions available to forwarding templates
+var templateFuncs = map[string]any{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// RuleTemplates returns the forwarding templates of a rule
+func RuleTemplates(rule *model.ForwardRule) ForwardTemplates {
+	return ForwardTemplates{
+		Subject: rule.SubjectTemplate,
+		Header:  rule.HeaderTemplate,
+		Footer:  rule.FooterTemplate,
+	}
+}
+
+// ValidateTemplates parses the templates and renders them against a sample
+// email, so unknown fields are reported when the rule is saved
+func ValidateTemplates(templates ForwardTemplates) error {
+	rule := model.ForwardRule{
+		SubjectTemplate: templates.Subject,
+		HeaderTemplate:  templates.Header,
+		FooterTemplate:  templates.Footer,
+	}
+
+	_, err := renderPreview(&rule, SampleEmail(&rule), SubjectParts{Keyword: "sample", Recipient: "Alice"})
+	return err
+}
+
+// SampleEmail returns the sample email used to preview the templates of a
+// rule. Its subject carries the rule keyword and the recipient name "Alice".
+func SampleEmail(rule *model.ForwardRule) EmailMessage {
+	keyword := rule.Keyword
+	if keyword == "" || normalizeMatchType(rule.MatchType) != model.MatchTypeExact {
+		keyword = "sample"
+	}
+
+	return EmailMessage{
+		ID:      "<sample-message@example.com>",
+		Subject: keyword + " - Alice",
+		From:    "Jane Sender <jane@example.com>",
+		To:      []string{"inbox@example.com"},
+		Body:    "Hello,\r\n\r\nThis is a sample message.\r\n",
+		Headers: map[string]string{
+			"Date": "Mon, 02 Jan 2006 15:04:05 -0700",
+		},
+	}
+}
+
+// PreviewForward renders the subject and bodies a rule would produce when
+// forwarding email inline. The keyword and recipient name are extracted from
+// the subject of email with the parser's subject grammar.
+func (p *EmailParser) PreviewForward(rule *model.ForwardRule, email EmailMessage) (*ForwardPreview, error) {
+	return renderPreview(rule, email, p.ParseSubject(email.Subject))
+}
+
+// renderPreview renders the inline forward of email for a rule
+func renderPreview(rule *model.ForwardRule, email EmailMessage, parts SubjectParts) (*ForwardPreview, error) {
+	text, err := renderForwardText(email, ForwardOptions{
+		Templates: RuleTemplates(rule),
+		Subject:   parts,
+		Rule:      rule,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	textBody, htmlBody := forwardBodies(email, text)
+	return &ForwardPreview{
+		Subject:  text.subject,
+		TextBody: textBody,
+		HTMLBody: htmlBody,
+	}, nil
+}
+
+// renderForwardText renders the subject, header block and footer of a
+// forwarded email. Header and footer templates are rendered with text/template
+// for the plain text part and with html/template, which escapes the values,
+// for the HTML part.
+func renderForwardText(original EmailMessage, opts ForwardOptions) (forwardText, error) {
+	data := newTemplateData(original, opts)
+	templates := opts.Templates
+
+	text := forwardText{
+		subject:    "Fwd: " + original.Subject,
+		headerText: forwardHeaderText(original),
+	}
+
+	if templates.Subject != "" {
+		subject, err := renderText("subject", templates.Subject, data)
+		if err != nil {
+			return text, err
+		}
+		// Header values cannot span lines
+		text.subject = strings.Join(strings.Fields(subject), " ")
+	}
+
+	if templates.Header != "" {
+		var err error
+		if text.headerText, err = renderText("header", templates.Header, data); err != nil {
+			return text, err
+		}
+		if text.headerHTML, err = renderHTML("header", templates.Header, data); err != nil {
+			return text, err
+		}
+		text.headerText = ensureTrailingBlankLine(text.headerText)
+	} else {
+		text.headerHTML = "<div>" + strings.ReplaceAll(htmltemplate.HTMLEscapeString(text.headerText), "\r\n", "<br>\r\n") + "</div>\r\n"
+	}
+
+	if templates.Footer != "" {
+		var err error
+		if text.footerText, err = renderText("footer", templates.Footer, data); err != nil {
+			return text, err
+		}
+		if text.footerHTML, err = renderHTML("footer", templates.Footer, data); err != nil {
+			return text, err
+		}
+		text.footerText = "\r\n" + text.footerText
+	}
+
+	return text, nil
+}
+
+// newTemplateData builds the template data of a forwarded email
+func newTemplateData(original EmailMessage, opts ForwardOptions) TemplateData {
+	data := TemplateData{
+		Subject:   original.Subject,
+		From:      original.From,
+		To:        original.To,
+		Cc:        original.CC,
+		Date:      original.Headers["Date"],
+		MessageID: original.ID,
+		Headers:   original.Headers,
+		Body:      original.Body,
+		Keyword:   opts.Subject.Keyword,
+		Recipient: opts.Subject.Recipient,
+	}
+	if opts.Rule != nil {
+		data.Rule = *opts.Rule
+	}
+	if data.Body == "" && original.HTMLBody != "" {
+		data.Body = htmlToPlainText(original.HTMLBody)
+	}
+	return data
+}
+
+// renderText renders a text/template with CRLF line endings
+func renderText(name, source string, data TemplateData) (string, error) {
+	tmpl, err := texttemplate.New(name).Funcs(templateFuncs).Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+	return crlf(buf.String()), nil
+}
+
+// renderHTML renders an html/template into a block that keeps the line breaks
+// of the template
+func renderHTML(name, source string, data TemplateData) (string, error) {
+	tmpl, err := htmltemplate.New(name).Funcs(templateFuncs).Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", name, err)
+	}
+	return `<div style="white-space: pre-wrap">` + crlf(buf.String()) + "</div>\r\n", nil
+}
+
+// crlf normalizes line endings to CRLF
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// ensureTrailingBlankLine separates a header block from the body below it
+func ensureTrailingBlankLine(s string) string {
+	s = strings.TrimRight(s, "\r\n")
+	if s == "" {
+		return ""
+	}
+	return s + "\r\n\r\n"
+}